@@ -1,16 +1,59 @@
 package cache
 
-import "errors"
+import (
+	"errors"
+	"io"
+)
 
 var (
 	// ErrCacheMiss cache miss
 	ErrCacheMiss = errors.New("Value not in cache")
+	// ErrPartialHit request is only partially covered by the cache, see
+	// GetResult.Gaps for the byte ranges that still need to be fetched
+	ErrPartialHit = errors.New("Value partially in cache")
 )
 
+// Range is a half open byte range [Start, End) within a sourceURL
+type Range struct {
+	Start int
+	End   int
+}
+
+// Chunk is a Range paired with the bytes the cache holds for it
+type Chunk struct {
+	Range
+	Buffer []byte
+}
+
+// GetResult is returned by Cache.Get. Chunks holds the cached bytes found
+// for the request, in ascending order and non-overlapping. Gaps holds the
+// byte ranges, also in ascending order, that were not found in the cache
+// and must be fetched from the origin to satisfy the request in full.
+type GetResult struct {
+	Chunks []Chunk
+	Gaps   []Range
+}
+
+// CacheWriter accepts a stream of bytes for a single origin fetch and
+// commits them to the cache in fixed-size chunks as they arrive, so a long
+// response never has to be buffered in full just to be cached.
+type CacheWriter interface {
+	io.Writer
+	// Close flushes any remaining buffered bytes as a final, possibly
+	// short, chunk.
+	Close() error
+}
+
 // Cache Interface for implementing a LRU cache
 type Cache interface {
 	// Put Place item into cache and handles evictions
 	Put(start, end int, buffer []byte, sourceURL string) error
-	// Get Retreives items from the cache
-	Get(start, end int, sourceURL string) ([]byte, error)
+	// Get Retreives items from the cache. A nil error means the request
+	// was fully covered (Gaps is empty). ErrPartialHit means Chunks holds
+	// whatever was covered and Gaps holds what's missing. ErrCacheMiss
+	// means nothing was found and Gaps holds the full requested range.
+	Get(start, end int, sourceURL string) (*GetResult, error)
+	// NewWriter returns a CacheWriter that commits bytes for sourceURL,
+	// starting at start, to the cache as they're written to it.
+	NewWriter(start int, sourceURL string) (CacheWriter, error)
 }
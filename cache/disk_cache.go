@@ -0,0 +1,476 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sidecar is the metadata persisted alongside each cached range's data
+// file on disk.
+type sidecar struct {
+	Start        int    `json:"start"`
+	End          int    `json:"end"`
+	SourceURL    string `json:"sourceURL"`
+	MTime        int64  `json:"mtime"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastModified,omitempty"`
+}
+
+// diskEntry is the in-memory record of one cached range living on disk,
+// used to answer Get without scanning sidecar files on every call.
+type diskEntry struct {
+	Range
+	key   string
+	mtime time.Time
+	atime time.Time
+}
+
+// DiskCache is a Cache implementation that persists byte ranges to files
+// under a directory, meant to sit behind MemCache as an L2 via
+// TieredCache. Each cached range is a data file named by a hash of
+// (sourceURL, start, end) plus a JSON sidecar holding its metadata.
+type DiskCache struct {
+	dir          string
+	maxAge       time.Duration // -1 means entries never expire by age
+	maxDiskBytes int64
+
+	lock  sync.Mutex
+	index map[string][]*diskEntry // sourceURL -> entries sorted by start
+
+	stop chan struct{}
+}
+
+// NewDiskCache builds a DiskCache rooted at pathTemplate, expanding the
+// :cacheDir and :tmpDir placeholders against the OS's cache and temp
+// directories. maxAge bounds how long an entry survives after it's
+// written (-1 means forever) and maxDiskMB bounds total disk usage; a
+// background sweeper enforces both.
+func NewDiskCache(pathTemplate string, maxAge time.Duration, maxDiskMB int) (*DiskCache, error) {
+	dir, err := resolvePathTemplate(pathTemplate)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	d := &DiskCache{
+		dir:          dir,
+		maxAge:       maxAge,
+		maxDiskBytes: int64(maxDiskMB) * 1000000,
+		index:        make(map[string][]*diskEntry),
+		stop:         make(chan struct{}),
+	}
+
+	if err := d.loadIndex(); err != nil {
+		return nil, err
+	}
+
+	go d.sweepLoop()
+
+	return d, nil
+}
+
+// Close stops the background sweeper. It does not delete anything on
+// disk.
+func (d *DiskCache) Close() {
+	close(d.stop)
+}
+
+// resolvePathTemplate expands the :cacheDir and :tmpDir placeholders in
+// template, mirroring the path templates tools like Hugo use to configure
+// their file caches.
+func resolvePathTemplate(template string) (string, error) {
+	if strings.Contains(template, ":cacheDir") {
+		dir, err := os.UserCacheDir()
+		if err != nil {
+			return "", err
+		}
+		template = strings.ReplaceAll(template, ":cacheDir", dir)
+	}
+	if strings.Contains(template, ":tmpDir") {
+		template = strings.ReplaceAll(template, ":tmpDir", os.TempDir())
+	}
+	return template, nil
+}
+
+// diskKey derives the file name used for a cached (sourceURL, start, end)
+// range.
+func diskKey(sourceURL string, start, end int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d", sourceURL, start, end)))
+	return hex.EncodeToString(sum[:])
+}
+
+// loadIndex rebuilds the in-memory index from the sidecar files already on
+// disk, so entries written by a previous process are found again.
+func (d *DiskCache) loadIndex() error {
+	matches, err := filepath.Glob(filepath.Join(d.dir, "*.json"))
+	if err != nil {
+		return err
+	}
+
+	for _, sidePath := range matches {
+		raw, err := ioutil.ReadFile(sidePath)
+		if err != nil {
+			continue
+		}
+		var side sidecar
+		if err := json.Unmarshal(raw, &side); err != nil {
+			continue
+		}
+
+		key := strings.TrimSuffix(filepath.Base(sidePath), ".json")
+		if _, err := os.Stat(filepath.Join(d.dir, key+".bin")); err != nil {
+			continue
+		}
+
+		entry := &diskEntry{
+			Range: Range{Start: side.Start, End: side.End},
+			key:   key,
+			mtime: time.Unix(side.MTime, 0),
+			atime: time.Unix(side.MTime, 0),
+		}
+		d.index[side.SourceURL] = append(d.index[side.SourceURL], entry)
+	}
+
+	for sourceURL := range d.index {
+		entries := d.index[sourceURL]
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Start < entries[j].Start })
+		d.index[sourceURL] = entries
+	}
+
+	return nil
+}
+
+// Put persists buffer for [start, end) under sourceURL, merging it with
+// any entry already on disk that overlaps or directly abuts the new
+// range, the same coalescing MemCache.Put does.
+func (d *DiskCache) Put(start, end int, buffer []byte, sourceURL string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	mergeable := d.mergeCandidates(start, end, sourceURL)
+
+	mergedStart, mergedEnd := start, end
+	for _, e := range mergeable {
+		if e.Start < mergedStart {
+			mergedStart = e.Start
+		}
+		if e.End > mergedEnd {
+			mergedEnd = e.End
+		}
+	}
+
+	mergedBuffer := make([]byte, mergedEnd-mergedStart)
+	copy(mergedBuffer[start-mergedStart:], buffer)
+	for _, e := range mergeable {
+		old, err := ioutil.ReadFile(filepath.Join(d.dir, e.key+".bin"))
+		if err != nil {
+			continue
+		}
+		copy(mergedBuffer[e.Start-mergedStart:], old)
+	}
+
+	key := diskKey(sourceURL, mergedStart, mergedEnd)
+	if err := d.writeEntry(key, mergedBuffer, sourceURL, mergedStart, mergedEnd); err != nil {
+		return err
+	}
+
+	for _, e := range mergeable {
+		if e.key == key {
+			continue
+		}
+		os.Remove(filepath.Join(d.dir, e.key+".bin"))
+		os.Remove(filepath.Join(d.dir, e.key+".json"))
+	}
+
+	kept := d.index[sourceURL][:0]
+	for _, e := range d.index[sourceURL] {
+		if !containsDiskEntry(mergeable, e) {
+			kept = append(kept, e)
+		}
+	}
+	now := time.Now()
+	kept = append(kept, &diskEntry{Range: Range{Start: mergedStart, End: mergedEnd}, key: key, mtime: now, atime: now})
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Start < kept[j].Start })
+	d.index[sourceURL] = kept
+
+	return nil
+}
+
+// writeEntry atomically writes the data file and sidecar for key via a
+// temp file + rename so a crash mid-write never leaves a corrupt entry
+// behind.
+func (d *DiskCache) writeEntry(key string, buffer []byte, sourceURL string, start, end int) error {
+	tmp, err := ioutil.TempFile(d.dir, key+".tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpName := tmp.Name()
+	if _, err := tmp.Write(buffer); err != nil {
+		tmp.Close()
+		os.Remove(tmpName)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+	if err := os.Rename(tmpName, filepath.Join(d.dir, key+".bin")); err != nil {
+		os.Remove(tmpName)
+		return err
+	}
+
+	side := sidecar{Start: start, End: end, SourceURL: sourceURL, MTime: time.Now().Unix()}
+	sideBytes, err := json.Marshal(side)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(d.dir, key+".json"), sideBytes, 0644)
+}
+
+func containsDiskEntry(list []*diskEntry, e *diskEntry) bool {
+	for _, candidate := range list {
+		if candidate == e {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeCandidates returns every entry for sourceURL overlapping or
+// directly abutting [start, end).
+func (d *DiskCache) mergeCandidates(start, end int, sourceURL string) []*diskEntry {
+	var hits []*diskEntry
+	for _, e := range d.index[sourceURL] {
+		if e.Start > end {
+			break
+		}
+		if e.Start <= end && e.End >= start {
+			hits = append(hits, e)
+		}
+	}
+	return hits
+}
+
+// overlapping returns every entry for sourceURL that overlaps
+// [start, end).
+func (d *DiskCache) overlapping(start, end int, sourceURL string) []*diskEntry {
+	var hits []*diskEntry
+	for _, e := range d.index[sourceURL] {
+		if e.Start >= end {
+			break
+		}
+		if e.Start < end && start < e.End {
+			hits = append(hits, e)
+		}
+	}
+	return hits
+}
+
+// Get retreives [start, end) for sourceURL, reading whatever data files
+// cover it and reporting the rest as gaps, same as MemCache.Get.
+func (d *DiskCache) Get(start, end int, sourceURL string) (*GetResult, error) {
+	d.lock.Lock()
+	hits := d.overlapping(start, end, sourceURL)
+	d.lock.Unlock()
+
+	if len(hits) == 0 {
+		return &GetResult{Gaps: []Range{{Start: start, End: end}}}, ErrCacheMiss
+	}
+
+	result := &GetResult{}
+	cursor := start
+	for _, e := range hits {
+		if e.Start > cursor {
+			result.Gaps = append(result.Gaps, Range{Start: cursor, End: e.Start})
+		}
+
+		chunkStart, chunkEnd := cursor, end
+		if e.Start > chunkStart {
+			chunkStart = e.Start
+		}
+		if e.End < chunkEnd {
+			chunkEnd = e.End
+		}
+		if chunkEnd <= chunkStart {
+			continue
+		}
+
+		buffer, err := d.readRange(e, chunkStart, chunkEnd)
+		if err != nil {
+			// Missing or corrupt data file, treat it as a gap rather than
+			// failing the whole request.
+			result.Gaps = append(result.Gaps, Range{Start: chunkStart, End: chunkEnd})
+			cursor = chunkEnd
+			continue
+		}
+
+		result.Chunks = append(result.Chunks, Chunk{Range: Range{Start: chunkStart, End: chunkEnd}, Buffer: buffer})
+		d.lock.Lock()
+		e.atime = time.Now()
+		d.lock.Unlock()
+
+		cursor = chunkEnd
+	}
+	if cursor < end {
+		result.Gaps = append(result.Gaps, Range{Start: cursor, End: end})
+	}
+
+	if len(result.Gaps) > 0 {
+		return result, ErrPartialHit
+	}
+	return result, nil
+}
+
+func (d *DiskCache) readRange(e *diskEntry, start, end int) ([]byte, error) {
+	f, err := os.Open(filepath.Join(d.dir, e.key+".bin"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	buffer := make([]byte, end-start)
+	if _, err := f.ReadAt(buffer, int64(start-e.Start)); err != nil {
+		return nil, err
+	}
+	return buffer, nil
+}
+
+// NewWriter returns a CacheWriter that commits bytes for sourceURL,
+// starting at start, straight to disk in chunkSize chunks via Put.
+func (d *DiskCache) NewWriter(start int, sourceURL string) (CacheWriter, error) {
+	return &diskCacheWriter{disk: d, sourceURL: sourceURL, cursor: start, buf: make([]byte, 0, defaultChunkSize)}, nil
+}
+
+type diskCacheWriter struct {
+	disk      *DiskCache
+	sourceURL string
+	cursor    int
+	buf       []byte
+}
+
+func (w *diskCacheWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		room := cap(w.buf) - len(w.buf)
+		n := len(p)
+		if n > room {
+			n = room
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == cap(w.buf) {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+func (w *diskCacheWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+	err := w.disk.Put(w.cursor, w.cursor+len(w.buf), w.buf, w.sourceURL)
+	w.cursor += len(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+func (w *diskCacheWriter) Close() error {
+	return w.flush()
+}
+
+// sweepLoop periodically enforces maxAge and maxDiskBytes until Close is
+// called.
+func (d *DiskCache) sweepLoop() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-d.stop:
+			return
+		case <-ticker.C:
+			d.sweepOnce()
+		}
+	}
+}
+
+// sweepOnce deletes entries older than maxAge, then, if still over
+// maxDiskBytes, evicts the least recently accessed entries until back
+// under budget.
+func (d *DiskCache) sweepOnce() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	now := time.Now()
+
+	if d.maxAge >= 0 {
+		for sourceURL, entries := range d.index {
+			kept := entries[:0]
+			for _, e := range entries {
+				if now.Sub(e.mtime) > d.maxAge {
+					os.Remove(filepath.Join(d.dir, e.key+".bin"))
+					os.Remove(filepath.Join(d.dir, e.key+".json"))
+					continue
+				}
+				kept = append(kept, e)
+			}
+			d.index[sourceURL] = kept
+		}
+	}
+
+	if d.maxDiskBytes <= 0 {
+		return
+	}
+
+	type indexed struct {
+		sourceURL string
+		entry     *diskEntry
+	}
+	var all []indexed
+	var total int64
+	for sourceURL, entries := range d.index {
+		for _, e := range entries {
+			total += int64(e.End - e.Start)
+			all = append(all, indexed{sourceURL, e})
+		}
+	}
+	if total <= d.maxDiskBytes {
+		return
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].entry.atime.Before(all[j].entry.atime) })
+
+	for _, it := range all {
+		if total <= d.maxDiskBytes {
+			break
+		}
+
+		os.Remove(filepath.Join(d.dir, it.entry.key+".bin"))
+		os.Remove(filepath.Join(d.dir, it.entry.key+".json"))
+		total -= int64(it.entry.End - it.entry.Start)
+
+		entries := d.index[it.sourceURL]
+		for i, cand := range entries {
+			if cand == it.entry {
+				d.index[it.sourceURL] = append(entries[:i], entries[i+1:]...)
+				break
+			}
+		}
+	}
+}
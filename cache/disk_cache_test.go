@@ -0,0 +1,64 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDiskCachePutGet(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	putBytes := make([]byte, 30)
+	d.Put(50, 80, putBytes, "source-hash")
+
+	result, err := d.Get(50, 80, "source-hash")
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 30 {
+		t.Errorf("Could not fetch the correct data, got %+v, err %v", result, err)
+	}
+}
+
+func TestDiskCachePartialHit(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Put(50, 80, make([]byte, 30), "source-hash")
+
+	result, err := d.Get(40, 90, "source-hash")
+	if err != ErrPartialHit {
+		t.Errorf("expected a partial hit, got %v", err)
+	}
+	if len(result.Gaps) != 2 {
+		t.Errorf("expected gaps on both sides of the stored range, got %+v", result.Gaps)
+	}
+}
+
+func TestDiskCacheMaxAgeSweep(t *testing.T) {
+	dir := t.TempDir()
+	d, err := NewDiskCache(dir, -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	d.Put(0, 30, make([]byte, 30), "source-hash")
+
+	// Pretend the entry was written long enough ago to have expired, then
+	// run the sweep directly instead of waiting on its ticker.
+	d.maxAge = time.Millisecond
+	d.index["source-hash"][0].mtime = time.Now().Add(-time.Hour)
+	d.sweepOnce()
+
+	_, err = d.Get(0, 30, "source-hash")
+	if err != ErrCacheMiss {
+		t.Errorf("expected the swept entry to come back as a cache miss, got %v", err)
+	}
+}
@@ -38,13 +38,24 @@ func (lh *lruHeap) Pop() interface{} {
 	return item
 }
 
+// defaultChunkSize is the size, in bytes, a CacheWriter buffers before
+// committing a chunk to the cache, used whenever NewMemCache is given a
+// chunkSize of 0.
+const defaultChunkSize = 256 * 1024
+
 // MemCache is an in memory LRU-Cache
 type MemCache struct {
-	maxSize     int
-	currentSize int
-	lru         *lruHeap
-	lock        sync.Mutex
-	sourceMap   map[string]*metaList
+	maxSize       int
+	maxObjectSize int
+	currentSize   int
+	// reserved tracks capacity claimed by in-flight CacheWriters that
+	// hasn't landed in currentSize yet, so evict doesn't free space a
+	// writer is about to need and corrupt its in-flight stream.
+	reserved  int
+	chunkSize int
+	lru       *lruHeap
+	lock      sync.Mutex
+	sourceMap map[string]*metaList
 }
 
 // Implements object for holding meta-data and byte array for cache entries
@@ -63,62 +74,143 @@ type lruObject struct {
 	ptr   *metaObject
 }
 
-// NewMemCache cache factory
-func NewMemCache(sizeMb int) *MemCache {
-	size := sizeMb * 1000000
+// NewMemCache cache factory. sizeMb bounds total cache capacity,
+// maxObjectSizeMb bounds the largest single Put (or merge result) the
+// cache will hold, and chunkSize sets the CacheWriter flush size in bytes
+// (0 selects defaultChunkSize).
+func NewMemCache(sizeMb int, maxObjectSizeMb int, chunkSize int) *MemCache {
+	if chunkSize <= 0 {
+		chunkSize = defaultChunkSize
+	}
+
 	lh := &lruHeap{}
 	heap.Init(lh)
 
 	return &MemCache{
-		maxSize:   size,
-		lru:       lh,
-		sourceMap: make(map[string]*metaList),
+		maxSize:       sizeMb * 1000000,
+		maxObjectSize: maxObjectSizeMb * 1000000,
+		chunkSize:     chunkSize,
+		lru:           lh,
+		sourceMap:     make(map[string]*metaList),
 	}
 }
 
-// Private function for handling evictions of objects from cache
+// Private function for handling evictions of objects from cache. It stops
+// once the lru heap empties, however far short of toFree that leaves it:
+// in-flight CacheWriter reservations (c.reserved) aren't represented in
+// the heap and so can't be evicted, and a caller asking to free more than
+// every stored object together would free gets an emptied heap, not a
+// panic popping an empty heap.
 func (c *MemCache) evict(toFree int) {
-	freeSpace := c.maxSize - c.currentSize
+	freeSpace := c.maxSize - c.currentSize - c.reserved
 
-	for freeSpace < toFree {
+	for freeSpace < toFree && c.lru.Len() > 0 {
 		var lru *lruObject
 		lru = c.lru.Pop().(*lruObject)
 		targetMetaList := c.sourceMap[lru.ptr.sourceURL]
 
-		metaIndex, _ := c.search(lru.ptr.start, lru.ptr.end, lru.ptr.sourceURL)
-		freeSpace = freeSpace + targetMetaList.list[metaIndex].size
+		freeSpace = freeSpace + lru.ptr.size
+		c.currentSize -= lru.ptr.size
 
-		// Delete item from list
-		targetMetaList.list = append(targetMetaList.list[:metaIndex], targetMetaList.list[metaIndex+1:]...)
+		// Delete the evicted metaObject from its metaList
+		for i, m := range targetMetaList.list {
+			if m == lru.ptr {
+				targetMetaList.list = append(targetMetaList.list[:i], targetMetaList.list[i+1:]...)
+				break
+			}
+		}
 	}
 }
 
-// Put places item into cache
+// Put places item into cache, merging it with any adjacent/overlapping
+// metaObject already stored for sourceURL so the metaList doesn't
+// fragment into many small entries covering the same bytes.
 func (c *MemCache) Put(start, end int, buffer []byte, sourceURL string) error {
 	// Locks cache
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// If buffer is larger then cache maxSize, do not place into cache
-	if len(buffer) > c.maxSize {
+	// A single object larger than maxObjectSize is never cached.
+	if (end - start) > c.maxObjectSize {
+		return nil
+	}
+
+	// Find any stored metaObject that overlaps or directly touches
+	// [start, end) so it can be merged into the incoming buffer instead of
+	// stored alongside it.
+	mergeable := c.mergeCandidates(start, end, sourceURL)
+
+	mergedStart, mergedEnd := start, end
+	for _, m := range mergeable {
+		if m.start < mergedStart {
+			mergedStart = m.start
+		}
+		if m.end > mergedEnd {
+			mergedEnd = m.end
+		}
+	}
+
+	// If merging would widen the stored object past maxObjectSize, don't
+	// merge: store the incoming buffer on its own instead of folding it
+	// into the neighbors, so the new bytes aren't silently dropped just
+	// because a long-lived source has grown past the cap.
+	if (mergedEnd - mergedStart) > c.maxObjectSize {
+		mergeable = nil
+		mergedStart, mergedEnd = start, end
+	}
+
+	mergedBuffer := make([]byte, mergedEnd-mergedStart)
+	copy(mergedBuffer[start-mergedStart:], buffer)
+	for _, m := range mergeable {
+		copy(mergedBuffer[m.start-mergedStart:], m.buffer)
+	}
+
+	addedSize := len(mergedBuffer)
+	for _, m := range mergeable {
+		addedSize -= m.size
+	}
+
+	// If this object could never fit even with the whole cache evicted,
+	// refuse it outright, the same guard used before maxObjectSize existed.
+	if addedSize > c.maxSize {
 		return nil
 	}
 
 	// If buffer + current size of cache is greater then max, we need to evict items from cache
-	if (len(buffer) + c.currentSize) > c.maxSize {
-		c.evict(len(buffer))
+	if (addedSize + c.currentSize + c.reserved) > c.maxSize {
+		c.evict(addedSize)
+
+		// In-flight CacheWriter reservations aren't represented in the lru
+		// heap and so can't be evicted; if they account for enough of the
+		// cache that evicting everything else still isn't enough room,
+		// skip this Put rather than let currentSize run over maxSize.
+		if (addedSize + c.currentSize + c.reserved) > c.maxSize {
+			return nil
+		}
 	}
 
-	// Create new buffer for metaObj creation
-	newBuffer := make([]byte, len(buffer))
-	copy(newBuffer, buffer)
+	// Remove the merged-away entries from the metaList and lru heap, they're
+	// superseded by the new, wider metaObject below.
+	if len(mergeable) > 0 {
+		targetMetaList := c.sourceMap[sourceURL]
+		kept := targetMetaList.list[:0]
+		for _, m := range targetMetaList.list {
+			if !containsMeta(mergeable, m) {
+				kept = append(kept, m)
+			} else {
+				c.currentSize -= m.size
+				c.removeLru(m.lru)
+			}
+		}
+		targetMetaList.list = kept
+	}
 
 	// Create metObj
 	newMeta := &metaObject{
-		start:     start,
-		end:       end,
-		buffer:    newBuffer, // Holds bytes within specified byte ranges
-		size:      len(buffer),
+		start:     mergedStart,
+		end:       mergedEnd,
+		buffer:    mergedBuffer, // Holds bytes within specified byte ranges
+		size:      len(mergedBuffer),
 		sourceURL: sourceURL,
 	}
 
@@ -150,78 +242,194 @@ func (c *MemCache) Put(start, end int, buffer []byte, sourceURL string) error {
 	return nil
 }
 
-// Get retreives items from the cache
-func (c *MemCache) Get(start, end int, sourceURL string) ([]byte, error) {
+// containsMeta reports whether m is present in list, used by Put to tell
+// surviving metaObjects apart from ones that were folded into a merge.
+func containsMeta(list []*metaObject, m *metaObject) bool {
+	for _, candidate := range list {
+		if candidate == m {
+			return true
+		}
+	}
+	return false
+}
 
-	var targetMetaList *metaList
+// removeLru drops target from the lru heap. Evictions are rare relative to
+// lookups so a linear scan to find the element is an acceptable trade-off
+// against keeping heap indices mirrored on metaObject.
+func (c *MemCache) removeLru(target *lruObject) {
+	for i, o := range *c.lru {
+		if o == target {
+			heap.Remove(c.lru, i)
+			return
+		}
+	}
+}
 
+// Get retreives items from the cache. When the requested [start, end) is
+// only partially covered by one or more stored metaObjects, the covered
+// spans are returned as Chunks alongside the Gaps that still need an
+// origin fetch.
+func (c *MemCache) Get(start, end int, sourceURL string) (*GetResult, error) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 
-	// Test to see if sourceURL is in sourceMap
-	if t, ok := c.sourceMap[sourceURL]; ok {
-		targetMetaList = t
-	} else {
-		return nil, ErrCacheMiss
+	hits := c.search(start, end, sourceURL)
+	if len(hits) == 0 {
+		return &GetResult{Gaps: []Range{{Start: start, End: end}}}, ErrCacheMiss
 	}
 
-	// Attempt to retrieve index of meta index if found in metaList
-	metaIndex, found := c.search(start, end, sourceURL)
-	if !found {
-		return nil, ErrCacheMiss
-	}
+	result := &GetResult{}
+	cursor := start
+	for _, targetMeta := range hits {
+		if targetMeta.start > cursor {
+			result.Gaps = append(result.Gaps, Range{Start: cursor, End: targetMeta.start})
+		}
 
-	// Define buffer for return
-	returnBuffer := make([]byte, end-start)
+		chunkStart, chunkEnd := cursor, end
+		if targetMeta.start > chunkStart {
+			chunkStart = targetMeta.start
+		}
+		if targetMeta.end < chunkEnd {
+			chunkEnd = targetMeta.end
+		}
+		if chunkEnd <= chunkStart {
+			continue
+		}
 
-	// Obtain target metaObject, byte range index conversion from metaObj index to provided byte range
-	targetMeta := targetMetaList.list[metaIndex]
-	targetStartIndex := start - targetMeta.start
-	targetEndIndex := targetStartIndex + (end - start)
+		returnBuffer := make([]byte, chunkEnd-chunkStart)
+		copy(returnBuffer, targetMeta.buffer[chunkStart-targetMeta.start:chunkEnd-targetMeta.start])
+		result.Chunks = append(result.Chunks, Chunk{Range: Range{Start: chunkStart, End: chunkEnd}, Buffer: returnBuffer})
 
-	// Copy buffer for return
-	copy(returnBuffer, targetMeta.buffer[targetStartIndex:targetEndIndex])
+		// Update metaObj's lru epoch timestamp
+		targetMeta.lru.epoch = time.Now().Unix()
+		heap.Fix(c.lru, c.lru.Len()-1)
 
-	// Update metaObj's lru epoch timestamp
-	targetMeta.lru.epoch = time.Now().Unix()
-	// Fix heap ordering after inclusion
-	heap.Fix(c.lru, c.lru.Len()-1)
+		cursor = chunkEnd
+	}
+	if cursor < end {
+		result.Gaps = append(result.Gaps, Range{Start: cursor, End: end})
+	}
 
-	return returnBuffer, nil
+	if len(result.Gaps) > 0 {
+		return result, ErrPartialHit
+	}
+	return result, nil
 }
 
-// Implementation of binary search, returns index of metaObj matching range provided
-func (c *MemCache) search(start, end int, sourceURL string) (int, bool) {
-	var mid int
-	var found bool
-	var targetMetaList *metaList
-
-	if _, ok := c.sourceMap[sourceURL]; !ok {
-		found = false
-		return 0, found
+// mergeCandidates walks the sorted metaList for sourceURL and returns every
+// stored metaObject that overlaps or directly abuts [start, end), in
+// ascending order by start. Used by Put to find entries to coalesce with.
+func (c *MemCache) mergeCandidates(start, end int, sourceURL string) []*metaObject {
+	targetMetaList, ok := c.sourceMap[sourceURL]
+	if !ok {
+		return nil
 	}
-	targetMetaList = c.sourceMap[sourceURL]
 
-	lower, upper := 0, len(targetMetaList.list)-1
+	var hits []*metaObject
+	for _, m := range targetMetaList.list {
+		if m.start > end {
+			break
+		}
+		if m.start <= end && m.end >= start {
+			hits = append(hits, m)
+		}
+	}
+	return hits
+}
 
-	for lower <= upper {
-		mid = (lower + upper) / 2
+// search walks the sorted metaList for sourceURL and returns every stored
+// metaObject that overlaps [start, end), in ascending order by start.
+func (c *MemCache) search(start, end int, sourceURL string) []*metaObject {
+	targetMetaList, ok := c.sourceMap[sourceURL]
+	if !ok {
+		return nil
+	}
 
-		if targetMetaList.list[mid].start <= start && start < targetMetaList.list[mid].end {
-			found = true
+	var hits []*metaObject
+	for _, m := range targetMetaList.list {
+		// list is sorted by start, once a candidate starts at or past end
+		// there can be no further overlaps
+		if m.start >= end {
 			break
 		}
+		if m.start < end && start < m.end {
+			hits = append(hits, m)
+		}
+	}
+	return hits
+}
 
-		if targetMetaList.list[mid].start < start {
-			lower = mid + 1
-		} else {
-			upper = mid - 1
+// memCacheWriter implements CacheWriter for MemCache. It buffers writes
+// into chunkSize chunks and Puts each one as it fills, rather than holding
+// a whole response in memory before it can be cached.
+type memCacheWriter struct {
+	cache     *MemCache
+	sourceURL string
+	cursor    int
+	chunkSize int
+	buf       []byte
+}
+
+// NewWriter returns a CacheWriter that commits bytes for sourceURL,
+// starting at start, to the cache in chunkSize chunks. It reserves a
+// chunk's worth of capacity for the lifetime of the writer so a
+// concurrent Put's eviction can't reach into space this writer is about
+// to need.
+func (c *MemCache) NewWriter(start int, sourceURL string) (CacheWriter, error) {
+	c.lock.Lock()
+	c.reserved += c.chunkSize
+	c.lock.Unlock()
+
+	return &memCacheWriter{
+		cache:     c,
+		sourceURL: sourceURL,
+		cursor:    start,
+		chunkSize: c.chunkSize,
+		buf:       make([]byte, 0, c.chunkSize),
+	}, nil
+}
+
+func (w *memCacheWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		room := w.chunkSize - len(w.buf)
+		n := len(p)
+		if n > room {
+			n = room
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+
+		if len(w.buf) == w.chunkSize {
+			if err := w.flush(); err != nil {
+				return written, err
+			}
 		}
 	}
+	return written, nil
+}
 
-	if found && end <= targetMetaList.list[mid].end {
-		found = true
+// flush commits the currently buffered bytes as one chunk.
+func (w *memCacheWriter) flush() error {
+	if len(w.buf) == 0 {
+		return nil
 	}
 
-	return mid, found
+	err := w.cache.Put(w.cursor, w.cursor+len(w.buf), w.buf, w.sourceURL)
+	w.cursor += len(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// Close flushes any buffered remainder as a final, possibly short, chunk
+// and releases this writer's reservation against the cache's capacity.
+func (w *memCacheWriter) Close() error {
+	err := w.flush()
+
+	w.cache.lock.Lock()
+	w.cache.reserved -= w.cache.chunkSize
+	w.cache.lock.Unlock()
+
+	return err
 }
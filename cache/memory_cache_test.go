@@ -5,77 +5,191 @@ import (
 	"testing"
 )
 
+// complexCache fills cache with disjoint ~100000 byte ranges for
+// "source-hash", leaving a 1 byte gap between each so Put's merge step
+// doesn't coalesce them into a single entry.
 func complexCache(cache *MemCache, max int) {
 	for i := 0; i < max; i = i + 100000 {
-		putBytes := make([]byte, 100000)
-		cache.Put(i, i+100000, putBytes, "source-hash")
+		putBytes := make([]byte, 99999)
+		cache.Put(i, i+99999, putBytes, "source-hash")
 		fmt.Printf("size %v\n", cache.currentSize)
 		fmt.Printf("elements %v\n", len(cache.sourceMap["source-hash"].list))
 	}
 }
 
 func TestSearchExactMatch(t *testing.T) {
-	cache := NewMemCache(1)
+	cache := NewMemCache(1, 1, 0)
 
 	putBytes := make([]byte, 30)
 	cache.Put(50, 80, putBytes, "source-hash")
 
-	fetchedBytes, err := cache.Get(50, 80, "source-hash")
+	result, err := cache.Get(50, 80, "source-hash")
 
-	if (err != nil) && (len(fetchedBytes) != 30) {
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 30 {
 		t.Errorf("Could not fetch the correct data")
 	}
 }
 
 func TestSearchNOMatch(t *testing.T) {
-	cache := NewMemCache(1)
+	cache := NewMemCache(1, 1, 0)
 
 	putBytes := make([]byte, 30)
 	cache.Put(50, 80, putBytes, "source-hash")
 
-	fetchedBytes, err := cache.Get(30, 40, "source-hash")
+	result, err := cache.Get(30, 40, "source-hash")
 
-	if (err == ErrCacheMiss) && (fetchedBytes != nil) {
-		t.Errorf("got a cache miss when data is not there")
+	if err != ErrCacheMiss || len(result.Gaps) != 1 || len(result.Chunks) != 0 {
+		t.Errorf("expected a full cache miss with a single gap covering the whole request")
 	}
 }
 
 func TestSearchSubMatch(t *testing.T) {
-	cache := NewMemCache(1)
+	cache := NewMemCache(1, 1, 0)
 
 	putBytes := make([]byte, 30)
 	cache.Put(50, 80, putBytes, "source-hash")
 
-	fetchedBytes, err := cache.Get(50, 70, "source-hash")
+	result, err := cache.Get(50, 70, "source-hash")
 
-	if (err == nil) && (len(fetchedBytes) != 20) {
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 20 {
 		t.Errorf("Could not fetch the correct data")
 	}
 }
 
+func TestSearchPartialMatch(t *testing.T) {
+	cache := NewMemCache(1, 1, 0)
+
+	putBytes := make([]byte, 30)
+	cache.Put(50, 80, putBytes, "source-hash")
+
+	result, err := cache.Get(40, 90, "source-hash")
+
+	if err != ErrPartialHit {
+		t.Errorf("expected a partial hit, got %v", err)
+	}
+	if len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 30 {
+		t.Errorf("expected the stored 30 byte chunk to come back")
+	}
+	if len(result.Gaps) != 2 || result.Gaps[0] != (Range{Start: 40, End: 50}) || result.Gaps[1] != (Range{Start: 80, End: 90}) {
+		t.Errorf("expected gaps on both sides of the stored range, got %+v", result.Gaps)
+	}
+}
+
+func TestPutMergesAdjacentRanges(t *testing.T) {
+	cache := NewMemCache(1, 1, 0)
+
+	cache.Put(0, 50, make([]byte, 50), "source-hash")
+	cache.Put(50, 100, make([]byte, 50), "source-hash")
+
+	if len(cache.sourceMap["source-hash"].list) != 1 {
+		t.Errorf("expected adjacent ranges to merge into a single metaObject, got %v entries", len(cache.sourceMap["source-hash"].list))
+	}
+
+	result, err := cache.Get(0, 100, "source-hash")
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 100 {
+		t.Errorf("Could not fetch the merged range")
+	}
+}
+
 func TestSearchExactMatchComplex(t *testing.T) {
-	cache := NewMemCache(1)
+	cache := NewMemCache(1, 1, 0)
 
 	complexCache(cache, 100)
 
-	fetchedBytes, err := cache.Get(70, 80, "source-hash")
+	result, err := cache.Get(70, 80, "source-hash")
 
-	if (err != nil) && (len(fetchedBytes) != 10) {
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 10 {
 		t.Errorf("Could not fetch the correct data")
 	}
 }
 
 func TestEvictComplex(t *testing.T) {
-	cache := NewMemCache(1)
+	cache := NewMemCache(1, 1, 0)
 
 	complexCache(cache, 1000000)
 
+	// An unrelated range forces an entry out of the cache.
 	putBytes := make([]byte, 50)
-	cache.Put(400, 450, putBytes, "source-hash")
+	cache.Put(5000000, 5000050, putBytes, "source-hash")
+
+	_, err := cache.Get(900000, 999999, "source-hash")
+
+	if err != ErrCacheMiss {
+		t.Errorf("expected the evicted range to come back as a cache miss, got %v", err)
+	}
+}
+
+func TestPutLargerThanMaxSizeDoesNotPanic(t *testing.T) {
+	cache := NewMemCache(0, 100, 0)
+
+	// Nothing is stored yet, so the lru heap is empty; evict must not be
+	// asked to free more than the (nonexistent) cache can ever supply.
+	if err := cache.Put(0, 1000, make([]byte, 1000), "source-hash"); err != nil {
+		t.Errorf("expected Put to reject an oversized object cleanly, got error %v", err)
+	}
+
+	if _, err := cache.Get(0, 1000, "source-hash"); err != ErrCacheMiss {
+		t.Errorf("expected the oversized Put to be rejected rather than stored, got %v", err)
+	}
+}
+
+func TestPutReservedCapacityDoesNotOverflowEviction(t *testing.T) {
+	// A cache whose entire capacity is claimed by in-flight CacheWriter
+	// reservations has nothing left for evict to free; evict must stop at
+	// the empty lru heap and Put must then reject cleanly.
+	cache := NewMemCache(1, 1, 0)
+	cache.reserved = cache.maxSize
+
+	if err := cache.Put(0, 100, make([]byte, 100), "source-hash"); err != nil {
+		t.Errorf("expected Put to reject cleanly when reserved capacity leaves no room, got error %v", err)
+	}
+
+	if _, err := cache.Get(0, 100, "source-hash"); err != ErrCacheMiss {
+		t.Errorf("expected the rejected Put to be absent from the cache, got %v", err)
+	}
+}
+
+func TestPutOverMaxObjectSizeStoresStandaloneInsteadOfDropping(t *testing.T) {
+	cache := NewMemCache(16, 1, 0)
 
-	fetchedBytes, err := cache.Get(0, 100000, "source-hash")
+	// Fill up to just under maxObjectSize (1,000,000 bytes) with
+	// sequential, adjacent chunks the way a CacheWriter would.
+	if err := cache.Put(0, 950000, make([]byte, 950000), "source-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	// This chunk is adjacent to the stored range, but merging the two
+	// would exceed maxObjectSize. It must still be stored, just on its
+	// own, rather than silently dropped.
+	if err := cache.Put(950000, 1050000, make([]byte, 100000), "source-hash"); err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := cache.Get(950000, 1050000, "source-hash")
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 100000 {
+		t.Errorf("expected the chunk that would have overflowed maxObjectSize to still be cached on its own, got result %+v, err %v", result, err)
+	}
+}
+
+func TestNewWriterChunksPuts(t *testing.T) {
+	cache := NewMemCache(1, 1, 10)
+
+	writer, err := cache.NewWriter(0, "source-hash")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 25 bytes at a chunkSize of 10 should land as two full chunks plus a
+	// short final one on Close.
+	if _, err := writer.Write(make([]byte, 25)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
 
-	if (err == ErrCacheMiss) && (fetchedBytes != nil) {
-		t.Errorf("got a cache miss when data is not there")
+	result, err := cache.Get(0, 25, "source-hash")
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 25 {
+		t.Errorf("expected the written chunks to merge into a single 25 byte range, got %+v, err %v", result, err)
 	}
 }
@@ -0,0 +1,40 @@
+package cache
+
+// SourceRoutedCache dispatches to a per-sourceURL override Cache when one
+// is configured for the requested sourceURL, falling back to a shared
+// default Cache otherwise. This lets operators size caches differently
+// for hot vs cold sources while still satisfying the single Cache
+// interface the rest of the service depends on.
+type SourceRoutedCache struct {
+	defaultCache Cache
+	overrides    map[string]Cache
+}
+
+// NewSourceRoutedCache builds a SourceRoutedCache that falls back to
+// defaultCache for any sourceURL not present in overrides.
+func NewSourceRoutedCache(defaultCache Cache, overrides map[string]Cache) *SourceRoutedCache {
+	return &SourceRoutedCache{defaultCache: defaultCache, overrides: overrides}
+}
+
+func (r *SourceRoutedCache) pick(sourceURL string) Cache {
+	if c, ok := r.overrides[sourceURL]; ok {
+		return c
+	}
+	return r.defaultCache
+}
+
+// Put places buffer into the cache assigned to sourceURL.
+func (r *SourceRoutedCache) Put(start, end int, buffer []byte, sourceURL string) error {
+	return r.pick(sourceURL).Put(start, end, buffer, sourceURL)
+}
+
+// Get retreives [start, end) from the cache assigned to sourceURL.
+func (r *SourceRoutedCache) Get(start, end int, sourceURL string) (*GetResult, error) {
+	return r.pick(sourceURL).Get(start, end, sourceURL)
+}
+
+// NewWriter returns a CacheWriter against the cache assigned to
+// sourceURL.
+func (r *SourceRoutedCache) NewWriter(start int, sourceURL string) (CacheWriter, error) {
+	return r.pick(sourceURL).NewWriter(start, sourceURL)
+}
@@ -0,0 +1,103 @@
+package cache
+
+import "sort"
+
+// TieredCache layers an L1 Cache (meant to be a fast MemCache) in front of
+// an L2 Cache (meant to be a DiskCache), satisfying the Cache interface by
+// checking l1 first and falling back to l2 for whatever l1 is missing.
+// Anything found in l2 is promoted back into l1 so the next lookup for the
+// same range doesn't need to touch disk at all.
+type TieredCache struct {
+	l1 Cache
+	l2 Cache
+}
+
+// NewTieredCache builds a TieredCache over l1 and l2.
+func NewTieredCache(l1, l2 Cache) *TieredCache {
+	return &TieredCache{l1: l1, l2: l2}
+}
+
+// Put writes buffer into both tiers.
+func (t *TieredCache) Put(start, end int, buffer []byte, sourceURL string) error {
+	if err := t.l1.Put(start, end, buffer, sourceURL); err != nil {
+		return err
+	}
+	return t.l2.Put(start, end, buffer, sourceURL)
+}
+
+// Get serves [start, end) out of l1, falling back to l2 for whatever l1
+// reports as a gap.
+func (t *TieredCache) Get(start, end int, sourceURL string) (*GetResult, error) {
+	result, err := t.l1.Get(start, end, sourceURL)
+	if err == nil {
+		return result, nil
+	}
+
+	l1Gaps := result.Gaps
+	result.Gaps = nil
+
+	for _, gap := range l1Gaps {
+		l2Result, l2Err := t.l2.Get(gap.Start, gap.End, sourceURL)
+		if l2Err != nil && l2Err != ErrPartialHit && l2Err != ErrCacheMiss {
+			return nil, l2Err
+		}
+
+		for _, chunk := range l2Result.Chunks {
+			// Promote what l2 already had back into l1.
+			go t.l1.Put(chunk.Start, chunk.End, chunk.Buffer, sourceURL)
+		}
+		result.Chunks = append(result.Chunks, l2Result.Chunks...)
+		result.Gaps = append(result.Gaps, l2Result.Gaps...)
+	}
+
+	sort.Slice(result.Chunks, func(i, j int) bool { return result.Chunks[i].Start < result.Chunks[j].Start })
+	sort.Slice(result.Gaps, func(i, j int) bool { return result.Gaps[i].Start < result.Gaps[j].Start })
+
+	if len(result.Chunks) == 0 {
+		return result, ErrCacheMiss
+	}
+	if len(result.Gaps) > 0 {
+		return result, ErrPartialHit
+	}
+	return result, nil
+}
+
+// NewWriter returns a CacheWriter that fans every write out to both tiers.
+func (t *TieredCache) NewWriter(start int, sourceURL string) (CacheWriter, error) {
+	l1w, err := t.l1.NewWriter(start, sourceURL)
+	if err != nil {
+		return nil, err
+	}
+	l2w, err := t.l2.NewWriter(start, sourceURL)
+	if err != nil {
+		l1w.Close()
+		return nil, err
+	}
+	return &tieredWriter{l1w: l1w, l2w: l2w}, nil
+}
+
+// tieredWriter fans writes out to both tiers' CacheWriters.
+type tieredWriter struct {
+	l1w CacheWriter
+	l2w CacheWriter
+}
+
+func (w *tieredWriter) Write(p []byte) (int, error) {
+	n, err := w.l1w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	if _, err := w.l2w.Write(p); err != nil {
+		return n, err
+	}
+	return n, nil
+}
+
+func (w *tieredWriter) Close() error {
+	err1 := w.l1w.Close()
+	err2 := w.l2w.Close()
+	if err1 != nil {
+		return err1
+	}
+	return err2
+}
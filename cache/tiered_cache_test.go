@@ -0,0 +1,25 @@
+package cache
+
+import "testing"
+
+func TestTieredCachePromotesFromL2(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := NewDiskCache(dir, -1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disk.Close()
+
+	mem := NewMemCache(1, 1, 0)
+	tiered := NewTieredCache(mem, disk)
+
+	// Put bypasses the tier directly, going only to disk, simulating data
+	// that was cached by a previous process and survived a mem cache
+	// restart.
+	disk.Put(0, 30, make([]byte, 30), "source-hash")
+
+	result, err := tiered.Get(0, 30, "source-hash")
+	if err != nil || len(result.Chunks) != 1 || len(result.Chunks[0].Buffer) != 30 {
+		t.Errorf("expected TieredCache.Get to fall back to l2, got %+v, err %v", result, err)
+	}
+}
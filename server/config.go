@@ -0,0 +1,105 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"path/filepath"
+	"time"
+
+	"github.com/ldelossa/vimeoserver/cache"
+)
+
+// SourceCacheConfig overrides the default cache tuning for one sourceURL,
+// letting operators size hot content differently from cold the way Hugo
+// lets you configure [caches.getjson] and [caches.images] independently.
+// A zero MemMB, DiskMB, or MaxAge falls back to the top-level CacheConfig
+// value.
+type SourceCacheConfig struct {
+	MemMB  int
+	DiskMB int
+	MaxAge time.Duration
+}
+
+// CacheConfig configures the layered cache NewVimeoService builds.
+type CacheConfig struct {
+	MemMB       int
+	MaxObjectMB int
+
+	// DiskDir enables a disk-backed L2 cache when non-empty. It's a path
+	// template supporting the :cacheDir and :tmpDir placeholders.
+	DiskDir string
+	DiskMB  int
+	MaxAge  time.Duration // -1 means entries never expire by age
+
+	SourceOverrides map[string]SourceCacheConfig
+}
+
+// DefaultCacheConfig is a sensible starting point: a 64MB memory cache,
+// a 16MB max single object, entries that never expire by age, and no
+// disk L2.
+func DefaultCacheConfig() CacheConfig {
+	return CacheConfig{MemMB: 64, MaxObjectMB: 16, MaxAge: -1}
+}
+
+// buildCache wires up the Cache implementation described by config.
+func buildCache(config CacheConfig) (cache.Cache, error) {
+	defaultCache, err := buildTieredCache(config.MemMB, config.MaxObjectMB, diskNamespace(config.DiskDir, "default"), config.DiskMB, config.MaxAge)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(config.SourceOverrides) == 0 {
+		return defaultCache, nil
+	}
+
+	overrides := make(map[string]cache.Cache, len(config.SourceOverrides))
+	for sourceURL, o := range config.SourceOverrides {
+		memMB, diskMB, maxAge := o.MemMB, o.DiskMB, o.MaxAge
+		if memMB == 0 {
+			memMB = config.MemMB
+		}
+		if diskMB == 0 {
+			diskMB = config.DiskMB
+		}
+		if maxAge == 0 {
+			maxAge = config.MaxAge
+		}
+
+		c, err := buildTieredCache(memMB, config.MaxObjectMB, diskNamespace(config.DiskDir, sourceURL), diskMB, maxAge)
+		if err != nil {
+			return nil, err
+		}
+		overrides[sourceURL] = c
+	}
+
+	return cache.NewSourceRoutedCache(defaultCache, overrides), nil
+}
+
+// buildTieredCache builds a memory cache, layering a disk cache behind it
+// as an L2 when diskDir is set.
+func buildTieredCache(memMB, maxObjectMB int, diskDir string, diskMB int, maxAge time.Duration) (cache.Cache, error) {
+	mem := cache.NewMemCache(memMB, maxObjectMB, 0)
+	if diskDir == "" {
+		return mem, nil
+	}
+
+	disk, err := cache.NewDiskCache(diskDir, maxAge, diskMB)
+	if err != nil {
+		return nil, err
+	}
+	return cache.NewTieredCache(mem, disk), nil
+}
+
+// diskNamespace derives a subdirectory of diskDir unique to namespace (the
+// default cache, or a SourceOverrides key), so the default cache and every
+// override get their own DiskCache directory. DiskCache.loadIndex globs
+// every sidecar file in its directory with no filter, so two instances
+// sharing one directory would load and sweep each other's entries under
+// the wrong maxAge/maxDiskBytes policy.
+func diskNamespace(diskDir, namespace string) string {
+	if diskDir == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(namespace))
+	return filepath.Join(diskDir, hex.EncodeToString(sum[:8]))
+}
@@ -0,0 +1,29 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// cacheMetrics are process-wide counters surfaced at /debug/cache,
+// incremented as streamGap issues origin fetches or coalesces onto one
+// already in flight.
+type cacheMetrics struct {
+	originFetches int64
+	coalescedHits int64
+}
+
+// debugCacheRequest reports cacheMetrics as JSON, for operators checking
+// how effectively concurrent requests are coalescing onto shared origin
+// fetches.
+func (s *VimeoService) debugCacheRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		OriginFetches int64 `json:"origin_fetches"`
+		CoalescedHits int64 `json:"coalesced_hits"`
+	}{
+		OriginFetches: atomic.LoadInt64(&s.metrics.originFetches),
+		CoalescedHits: atomic.LoadInt64(&s.metrics.coalescedHits),
+	})
+}
@@ -0,0 +1,323 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+
+	"github.com/ldelossa/vimeoserver/cache"
+)
+
+// Constant declaration
+const (
+	mp4HeadFetchSize    = 1 << 20 // 1 MiB, the first guess at how much of the front of the file holds ftyp+moov
+	mp4MaxHeadFetchSize = 1 << 24 // 16 MiB, give up doubling the head fetch past this and look for moov at the tail instead
+	mp4TailFetchSize    = 1 << 20 // 1 MiB, how much of the end of the file to check when moov trails mdat
+)
+
+var errMP4Parse = errors.New("mp4: could not locate or parse moov box")
+
+// mp4Info is the result of parsing an MP4's moov box once: the bytes
+// needed to resynthesize a trimmed file (ftyp, a raw copy of moov) plus,
+// per track, just enough of its sample tables to compute a
+// keyframe-aligned byte offset for an arbitrary seek time. It's cached
+// per sourceURL so repeat seeks into the same video skip straight to the
+// offset math.
+type mp4Info struct {
+	ftyp          []byte
+	moov          []byte
+	contentLength int64
+	tracks        []mp4Track
+}
+
+// mp4Track holds one trak's sample tables, trimmed down to what seeking
+// needs, plus enough bookkeeping to rewrite its chunk offsets in a copy
+// of the raw moov bytes.
+type mp4Track struct {
+	timescale    uint32
+	stts         []sttsEntry
+	stss         []uint32 // 1-based sync sample numbers; nil means every sample is a sync sample
+	stsc         []stscEntry
+	chunkOffsets []int64
+
+	// patchPos is the position in mp4Info.moov of the first chunk offset
+	// entry (just past the stco/co64 header's version/flags/count
+	// fields), letting seek rewrite offsets without re-parsing moov.
+	patchPos  int
+	patchIs64 bool
+}
+
+// parseMP4 fetches and parses just enough of sourceURL to locate moov and
+// its sample tables: a growing prefix of the file, falling back to a
+// fetch of the tail when moov trails mdat instead of leading it.
+func parseMP4(client *http.Client, sourceURL string, contentLength int64) (*mp4Info, error) {
+	if contentLength <= 0 {
+		return nil, errMP4Parse
+	}
+
+	var head []byte
+	var boxes []box
+	var moovBox box
+	var found bool
+
+	for fetchSize := int64(mp4HeadFetchSize); ; fetchSize *= 2 {
+		n := fetchSize
+		if n > contentLength {
+			n = contentLength
+		}
+
+		var err error
+		head, err = fetchRange(client, sourceURL, 0, n)
+		if err != nil {
+			return nil, err
+		}
+
+		boxes, _ = parseBoxes(head, 0)
+		if moovBox, found = findBox(boxes, "moov"); found && moovBox.payload(head, 0) != nil {
+			break
+		}
+		if n >= contentLength || fetchSize >= mp4MaxHeadFetchSize {
+			break
+		}
+	}
+
+	ftypBox, ok := findBox(boxes, "ftyp")
+	if !ok {
+		return nil, errMP4Parse
+	}
+	ftyp := append([]byte(nil), head[ftypBox.Start:ftypBox.PayloadEnd]...)
+
+	moovData, moovBase := head, int64(0)
+	if !found || moovBox.payload(head, 0) == nil {
+		// moov wasn't in the head fetch; it's common for it to trail mdat
+		// at the end of the file instead, so look there.
+		tailSize := int64(mp4TailFetchSize)
+		if tailSize > contentLength {
+			tailSize = contentLength
+		}
+		tailStart := contentLength - tailSize
+
+		tail, err := fetchRange(client, sourceURL, tailStart, contentLength)
+		if err != nil {
+			return nil, err
+		}
+
+		tailBoxes, _ := parseBoxes(tail, tailStart)
+		if moovBox, found = findBox(tailBoxes, "moov"); !found || moovBox.payload(tail, tailStart) == nil {
+			return nil, errMP4Parse
+		}
+		moovData, moovBase = tail, tailStart
+	}
+
+	moovRaw := append([]byte(nil), moovData[moovBox.Start-moovBase:moovBox.PayloadEnd-moovBase]...)
+
+	tracks, err := parseTracks(moovBox, moovData, moovBase)
+	if err != nil {
+		return nil, err
+	}
+
+	return &mp4Info{
+		ftyp:          ftyp,
+		moov:          moovRaw,
+		contentLength: contentLength,
+		tracks:        tracks,
+	}, nil
+}
+
+// parseTracks walks moov -> trak for every track, skipping any trak whose
+// sample tables can't be fully parsed rather than failing the whole file.
+func parseTracks(moovBox box, data []byte, dataBase int64) ([]mp4Track, error) {
+	moovPayload := moovBox.payload(data, dataBase)
+	if moovPayload == nil {
+		return nil, errMP4Parse
+	}
+	moovChildren, _ := parseBoxes(moovPayload, moovBox.PayloadStart)
+
+	var tracks []mp4Track
+	for _, trak := range moovChildren {
+		if trak.Type != "trak" {
+			continue
+		}
+		if t, err := parseTrack(trak, data, dataBase, moovBox.Start); err == nil {
+			tracks = append(tracks, t)
+		}
+	}
+
+	if len(tracks) == 0 {
+		return nil, errMP4Parse
+	}
+	return tracks, nil
+}
+
+// parseTrack walks trak -> mdia -> minf -> stbl to pull out the sample
+// tables pseudo-streaming needs: mdhd for the timescale, and
+// stts/stss/stsc/stco(or co64) for locating sync samples and their chunk
+// offsets.
+func parseTrack(trak box, data []byte, dataBase int64, moovStart int64) (mp4Track, error) {
+	trakChildren, _ := parseBoxes(trak.payload(data, dataBase), trak.PayloadStart)
+
+	mdia, ok := findBox(trakChildren, "mdia")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+	mdiaChildren, _ := parseBoxes(mdia.payload(data, dataBase), mdia.PayloadStart)
+
+	mdhd, ok := findBox(mdiaChildren, "mdhd")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+	timescale, ok := mdhdTimescale(mdhd.payload(data, dataBase))
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+
+	minf, ok := findBox(mdiaChildren, "minf")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+	minfChildren, _ := parseBoxes(minf.payload(data, dataBase), minf.PayloadStart)
+
+	stbl, ok := findBox(minfChildren, "stbl")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+	stblChildren, _ := parseBoxes(stbl.payload(data, dataBase), stbl.PayloadStart)
+
+	sttsBox, ok := findBox(stblChildren, "stts")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+	stscBox, ok := findBox(stblChildren, "stsc")
+	if !ok {
+		return mp4Track{}, errMP4Parse
+	}
+
+	var chunkBox box
+	var is64 bool
+	if b, ok := findBox(stblChildren, "co64"); ok {
+		chunkBox, is64 = b, true
+	} else if b, ok := findBox(stblChildren, "stco"); ok {
+		chunkBox, is64 = b, false
+	} else {
+		return mp4Track{}, errMP4Parse
+	}
+
+	var stss []uint32
+	if stssBox, ok := findBox(stblChildren, "stss"); ok {
+		stss = parseSTSS(stssBox.payload(data, dataBase))
+	}
+
+	return mp4Track{
+		timescale:    timescale,
+		stts:         parseSTTS(sttsBox.payload(data, dataBase)),
+		stss:         stss,
+		stsc:         parseSTSC(stscBox.payload(data, dataBase)),
+		chunkOffsets: parseChunkOffsets(chunkBox.payload(data, dataBase), is64),
+		patchPos:     int(chunkBox.PayloadStart-moovStart) + 8,
+		patchIs64:    is64,
+	}, nil
+}
+
+// seek computes the byte range of mdat data needed to start playback at
+// startSeconds, snapped to the nearest preceding sync sample of the
+// track most likely to be video (the one with a sync sample table), and
+// returns a copy of moov with every track's chunk offsets rewritten to
+// account for the data that will be trimmed from the front of mdat.
+func (info *mp4Info) seek(startSeconds float64) (cache.Range, []byte) {
+	primary := info.tracks[0]
+	for _, t := range info.tracks {
+		if len(t.stss) > 0 {
+			primary = t
+			break
+		}
+	}
+
+	sample := targetSample(primary.stts, primary.timescale, startSeconds)
+	sample = snapToSyncSample(primary.stss, sample)
+	trimOffset := chunkOffsetForSample(primary.stsc, primary.chunkOffsets, sample)
+	if trimOffset <= 0 {
+		return cache.Range{Start: 0, End: int(info.contentLength)}, info.moov
+	}
+
+	moov := append([]byte(nil), info.moov...)
+	for _, t := range info.tracks {
+		patchChunkOffsets(moov, t, trimOffset)
+	}
+
+	return cache.Range{Start: int(trimOffset), End: int(info.contentLength)}, moov
+}
+
+// patchChunkOffsets rewrites t's chunk offset entries in moov in place,
+// shifting each down by trimOffset to account for the mdat bytes before
+// trimOffset being dropped.
+func patchChunkOffsets(moov []byte, t mp4Track, trimOffset int64) {
+	entrySize := 4
+	if t.patchIs64 {
+		entrySize = 8
+	}
+
+	pos := t.patchPos
+	for _, offset := range t.chunkOffsets {
+		if pos+entrySize > len(moov) {
+			break
+		}
+
+		newOffset := offset - trimOffset
+		if newOffset < 0 {
+			newOffset = 0
+		}
+
+		if t.patchIs64 {
+			binary.BigEndian.PutUint64(moov[pos:pos+8], uint64(newOffset))
+		} else {
+			binary.BigEndian.PutUint32(moov[pos:pos+4], uint32(newOffset))
+		}
+		pos += entrySize
+	}
+}
+
+// writeMdatHeader writes a standalone mdat box header declaring length
+// bytes of payload, using the 64-bit largesize form when length doesn't
+// fit a 32-bit box size.
+func writeMdatHeader(w io.Writer, length int64) error {
+	size := length + 8
+	if size <= 0xFFFFFFFF {
+		var header [8]byte
+		binary.BigEndian.PutUint32(header[0:4], uint32(size))
+		copy(header[4:8], "mdat")
+		_, err := w.Write(header[:])
+		return err
+	}
+
+	var header [16]byte
+	binary.BigEndian.PutUint32(header[0:4], 1)
+	copy(header[4:8], "mdat")
+	binary.BigEndian.PutUint64(header[8:16], uint64(length+16))
+	_, err := w.Write(header[:])
+	return err
+}
+
+// fetchRange issues a ranged GET for [start, end) against sourceURL and
+// reads the whole response body, for the one-shot probes parseMP4 needs
+// rather than the chunked streaming proxyRequest does for client bodies.
+func fetchRange(client *http.Client, sourceURL string, start, end int64) ([]byte, error) {
+	req, err := http.NewRequest("GET", sourceURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusPartialContent {
+		return nil, ErrInvalidRange
+	}
+	return ioutil.ReadAll(resp.Body)
+}
@@ -0,0 +1,98 @@
+package server
+
+import "encoding/binary"
+
+// box is one parsed ISO base media file format box (what the MP4 spec
+// calls an "atom"). Start and PayloadStart/PayloadEnd are absolute byte
+// offsets into the source file, not just the buffer parseBoxes was given,
+// so boxes found in a head fetch and a tail fetch can be reasoned about
+// with the same offsets.
+type box struct {
+	Type         string
+	Start        int64
+	Size         int64 // total box size, including its header
+	PayloadStart int64
+	PayloadEnd   int64
+}
+
+// parseBoxes parses every top-level box fully contained in data, where
+// data holds the bytes starting at file offset base. If the last box's
+// declared size runs past the end of data, that box is still returned
+// (so the caller can identify which box it was) but truncated is set,
+// signalling that more bytes are needed to read its payload.
+func parseBoxes(data []byte, base int64) (boxes []box, truncated bool) {
+	pos := 0
+	for pos+8 <= len(data) {
+		size := int64(binary.BigEndian.Uint32(data[pos : pos+4]))
+		typ := string(data[pos+4 : pos+8])
+		headerLen := 8
+
+		if size == 1 {
+			if pos+16 > len(data) {
+				truncated = true
+				break
+			}
+			largesize := binary.BigEndian.Uint64(data[pos+8 : pos+16])
+			if largesize > 1<<62 {
+				// A largesize this big would overflow int64 negative (or
+				// simply isn't a real box) and drive pos negative on the
+				// next iteration; treat it as unparseable.
+				truncated = true
+				break
+			}
+			size = int64(largesize)
+			headerLen = 16
+		}
+
+		if size != 0 && size < int64(headerLen) {
+			// A box can't be smaller than its own header.
+			truncated = true
+			break
+		}
+
+		start := base + int64(pos)
+		b := box{Type: typ, Start: start, Size: size, PayloadStart: start + int64(headerLen)}
+
+		if size == 0 {
+			// A size of 0 means "box extends to EOF"; the caller resolves
+			// PayloadEnd once it knows the content length.
+			b.PayloadEnd = -1
+			boxes = append(boxes, b)
+			truncated = true
+			break
+		}
+
+		b.PayloadEnd = start + size
+		if int64(pos)+size > int64(len(data)) {
+			boxes = append(boxes, b)
+			truncated = true
+			break
+		}
+
+		boxes = append(boxes, b)
+		pos += int(size)
+	}
+	return boxes, truncated
+}
+
+// findBox returns the first box of typ in boxes, if present.
+func findBox(boxes []box, typ string) (box, bool) {
+	for _, b := range boxes {
+		if b.Type == typ {
+			return b, true
+		}
+	}
+	return box{}, false
+}
+
+// payload returns the slice of data holding b's payload, given that data
+// starts at file offset base. It returns nil if data does not fully cover
+// the payload.
+func (b box) payload(data []byte, base int64) []byte {
+	start := b.PayloadStart - base
+	end := b.PayloadEnd - base
+	if start < 0 || end < start || end > int64(len(data)) {
+		return nil
+	}
+	return data[start:end]
+}
@@ -0,0 +1,84 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ldelossa/vimeoserver/cache"
+)
+
+// mp4Request implements MP4 pseudo-streaming: given ?s=<url>&start=<seconds>,
+// it returns a standalone MP4 stream beginning at the keyframe nearest the
+// requested time, rather than making the client download from the start of
+// the file just to seek. It falls back to plain proxyRequest behavior
+// whenever the source isn't video/mp4 or its moov box can't be parsed.
+func (s *VimeoService) mp4Request(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+
+	if _, ok := params["s"]; !ok {
+		http.Error(w, "Source string not provided", http.StatusBadRequest)
+		return
+	}
+	sourceURL := strings.Trim(params["s"][0], "\"")
+
+	startParam := params.Get("start")
+	startSeconds, err := strconv.ParseFloat(startParam, 64)
+	if startParam == "" || err != nil || startSeconds < 0 {
+		http.Error(w, "Bad start parameter", http.StatusBadRequest)
+		return
+	}
+
+	contentLength, err := s.sourceValidation(sourceURL, w)
+	if err != nil {
+		return
+	}
+
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "video/mp4") {
+		s.proxyFull(w, sourceURL)
+		return
+	}
+
+	info, err := s.mp4InfoFor(sourceURL, contentLength)
+	if err != nil {
+		s.proxyFull(w, sourceURL)
+		return
+	}
+
+	rng, moov := info.seek(startSeconds)
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.WriteHeader(http.StatusOK)
+	w.Write(info.ftyp)
+	w.Write(moov)
+	if err := writeMdatHeader(w, int64(rng.End-rng.Start)); err != nil {
+		return
+	}
+
+	result, err := s.cache.Get(rng.Start, rng.End, sourceURL)
+	if err != nil && err != cache.ErrCacheMiss && err != cache.ErrPartialHit {
+		return
+	}
+	s.streamResult(w, r.Context(), sourceURL, result)
+}
+
+// mp4InfoFor returns the cached parsed moov for sourceURL, parsing and
+// caching it on first use.
+func (s *VimeoService) mp4InfoFor(sourceURL string, contentLength int64) (*mp4Info, error) {
+	s.mp4Lock.Lock()
+	info, ok := s.mp4Infos[sourceURL]
+	s.mp4Lock.Unlock()
+	if ok {
+		return info, nil
+	}
+
+	info, err := parseMP4(s.httpClient, sourceURL, contentLength)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mp4Lock.Lock()
+	s.mp4Infos[sourceURL] = info
+	s.mp4Lock.Unlock()
+	return info, nil
+}
@@ -0,0 +1,210 @@
+package server
+
+import "encoding/binary"
+
+// sttsEntry is one run-length encoded entry of the stts (time-to-sample)
+// box: count consecutive samples each lasting delta units of the track's
+// timescale.
+type sttsEntry struct {
+	count uint32
+	delta uint32
+}
+
+// stscEntry is one run-length encoded entry of the stsc
+// (sample-to-chunk) box: starting at firstChunk (1-based), chunks hold
+// samplesPerChunk samples each until the next entry's firstChunk.
+type stscEntry struct {
+	firstChunk      uint32
+	samplesPerChunk uint32
+}
+
+// mdhdTimescale reads the timescale field out of an mdhd box's payload,
+// accounting for the version 0 (32-bit) and version 1 (64-bit) layouts.
+func mdhdTimescale(payload []byte) (uint32, bool) {
+	if len(payload) < 1 {
+		return 0, false
+	}
+	version := payload[0]
+	if version == 1 {
+		if len(payload) < 28 {
+			return 0, false
+		}
+		return binary.BigEndian.Uint32(payload[20:24]), true
+	}
+	if len(payload) < 20 {
+		return 0, false
+	}
+	return binary.BigEndian.Uint32(payload[12:16]), true
+}
+
+// parseSTTS parses an stts box's payload into its run-length entries.
+func parseSTTS(payload []byte) []sttsEntry {
+	if len(payload) < 8 {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(payload[4:8])
+	entries := make([]sttsEntry, 0, count)
+	pos := 8
+	for i := uint32(0); i < count && pos+8 <= len(payload); i++ {
+		entries = append(entries, sttsEntry{
+			count: binary.BigEndian.Uint32(payload[pos : pos+4]),
+			delta: binary.BigEndian.Uint32(payload[pos+4 : pos+8]),
+		})
+		pos += 8
+	}
+	return entries
+}
+
+// parseSTSS parses an stss box's payload into its (1-based) sync sample
+// numbers.
+func parseSTSS(payload []byte) []uint32 {
+	if len(payload) < 8 {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(payload[4:8])
+	entries := make([]uint32, 0, count)
+	pos := 8
+	for i := uint32(0); i < count && pos+4 <= len(payload); i++ {
+		entries = append(entries, binary.BigEndian.Uint32(payload[pos:pos+4]))
+		pos += 4
+	}
+	return entries
+}
+
+// parseSTSC parses an stsc box's payload into its run-length entries,
+// dropping the sample description index, which pseudo-streaming has no
+// use for.
+func parseSTSC(payload []byte) []stscEntry {
+	if len(payload) < 8 {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(payload[4:8])
+	entries := make([]stscEntry, 0, count)
+	pos := 8
+	for i := uint32(0); i < count && pos+12 <= len(payload); i++ {
+		entries = append(entries, stscEntry{
+			firstChunk:      binary.BigEndian.Uint32(payload[pos : pos+4]),
+			samplesPerChunk: binary.BigEndian.Uint32(payload[pos+4 : pos+8]),
+		})
+		pos += 12
+	}
+	return entries
+}
+
+// parseSTSZ parses an stsz box's payload. When every sample shares one
+// size, uniform is non-zero and sizes is nil; otherwise sizes holds one
+// entry per sample.
+func parseSTSZ(payload []byte) (uniform uint32, sizes []uint32) {
+	if len(payload) < 12 {
+		return 0, nil
+	}
+	uniform = binary.BigEndian.Uint32(payload[4:8])
+	if uniform != 0 {
+		return uniform, nil
+	}
+
+	count := binary.BigEndian.Uint32(payload[8:12])
+	sizes = make([]uint32, 0, count)
+	pos := 12
+	for i := uint32(0); i < count && pos+4 <= len(payload); i++ {
+		sizes = append(sizes, binary.BigEndian.Uint32(payload[pos:pos+4]))
+		pos += 4
+	}
+	return 0, sizes
+}
+
+// parseChunkOffsets parses an stco (32-bit) or co64 (64-bit) box's
+// payload into absolute file offsets.
+func parseChunkOffsets(payload []byte, is64 bool) []int64 {
+	entrySize := 4
+	if is64 {
+		entrySize = 8
+	}
+	if len(payload) < 8 {
+		return nil
+	}
+	count := binary.BigEndian.Uint32(payload[4:8])
+	offsets := make([]int64, 0, count)
+	pos := 8
+	for i := uint32(0); i < count && pos+entrySize <= len(payload); i++ {
+		if is64 {
+			offsets = append(offsets, int64(binary.BigEndian.Uint64(payload[pos:pos+8])))
+		} else {
+			offsets = append(offsets, int64(binary.BigEndian.Uint32(payload[pos:pos+4])))
+		}
+		pos += entrySize
+	}
+	return offsets
+}
+
+// targetSample returns the 1-based number of the sample whose presentation
+// interval contains startSeconds (the last sample starting at or before
+// it), per the track's stts run-length table.
+func targetSample(stts []sttsEntry, timescale uint32, startSeconds float64) uint32 {
+	if timescale == 0 {
+		return 1
+	}
+	targetUnits := uint64(startSeconds * float64(timescale))
+
+	var sample uint32 = 1
+	var elapsed uint64
+	for _, e := range stts {
+		runUnits := uint64(e.count) * uint64(e.delta)
+		if elapsed+runUnits >= targetUnits && e.delta > 0 {
+			sample += uint32((targetUnits - elapsed) / uint64(e.delta))
+			return sample
+		}
+		sample += e.count
+		elapsed += runUnits
+	}
+	// Requested time is past the end of the track; snap to its last sample.
+	if sample > 1 {
+		return sample - 1
+	}
+	return 1
+}
+
+// snapToSyncSample snaps sample down to the nearest preceding sync
+// sample in stss. A nil stss means every sample is a sync sample.
+func snapToSyncSample(stss []uint32, sample uint32) uint32 {
+	if len(stss) == 0 {
+		return sample
+	}
+	best := stss[0]
+	for _, s := range stss {
+		if s > sample {
+			break
+		}
+		best = s
+	}
+	return best
+}
+
+// chunkOffsetForSample resolves the absolute file offset of the chunk
+// holding the given (1-based) sample, per the track's stsc run-length
+// table and stco/co64 chunk offsets.
+func chunkOffsetForSample(stsc []stscEntry, chunkOffsets []int64, sample uint32) int64 {
+	if len(stsc) == 0 || len(chunkOffsets) == 0 {
+		return 0
+	}
+
+	var samplesSeen uint32
+	for i, entry := range stsc {
+		chunkCount := uint32(len(chunkOffsets)) - entry.firstChunk + 1
+		if i+1 < len(stsc) {
+			chunkCount = stsc[i+1].firstChunk - entry.firstChunk
+		}
+
+		runSamples := chunkCount * entry.samplesPerChunk
+		if sample <= samplesSeen+runSamples {
+			chunkIndex := entry.firstChunk - 1 + (sample-samplesSeen-1)/entry.samplesPerChunk
+			if int(chunkIndex) >= len(chunkOffsets) {
+				chunkIndex = uint32(len(chunkOffsets)) - 1
+			}
+			return chunkOffsets[chunkIndex]
+		}
+		samplesSeen += runSamples
+	}
+
+	return chunkOffsets[len(chunkOffsets)-1]
+}
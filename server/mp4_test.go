@@ -0,0 +1,202 @@
+package server
+
+import (
+	"encoding/binary"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// u32 big-endian encodes v, the shorthand every box builder below uses for
+// its fixed-width fields.
+func u32(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func makeBox(typ string, payload []byte) []byte {
+	buf := make([]byte, 8+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(buf)))
+	copy(buf[4:8], typ)
+	copy(buf[8:], payload)
+	return buf
+}
+
+// buildSyntheticMP4 assembles a minimal, fast-start (moov before mdat)
+// MP4 with one track: 4 samples of 100 bytes each, one second apart
+// (timescale 1000, delta 1000), laid out in two chunks of two samples,
+// with samples 1 and 3 marked as sync samples. It returns the full file
+// bytes along with the absolute file offset where its second chunk (and
+// so sample 3) begins.
+func buildSyntheticMP4(t *testing.T) (file []byte, secondChunkOffset int64) {
+	t.Helper()
+
+	ftypBox := makeBox("ftyp", append(append([]byte("isom"), u32(0)...), []byte("isom")...))
+
+	mdhdPayload := make([]byte, 20)
+	binary.BigEndian.PutUint32(mdhdPayload[12:16], 1000) // timescale
+	mdhdBox := makeBox("mdhd", mdhdPayload)
+
+	sttsPayload := append([]byte{0, 0, 0, 0}, u32(1)...)
+	sttsPayload = append(sttsPayload, u32(4)...)    // sample_count
+	sttsPayload = append(sttsPayload, u32(1000)...) // sample_delta
+	sttsBox := makeBox("stts", sttsPayload)
+
+	stssPayload := append([]byte{0, 0, 0, 0}, u32(2)...)
+	stssPayload = append(stssPayload, u32(1)...) // sync sample 1
+	stssPayload = append(stssPayload, u32(3)...) // sync sample 3
+	stssBox := makeBox("stss", stssPayload)
+
+	stscPayload := append([]byte{0, 0, 0, 0}, u32(1)...)
+	stscPayload = append(stscPayload, u32(1)...) // first_chunk
+	stscPayload = append(stscPayload, u32(2)...) // samples_per_chunk
+	stscPayload = append(stscPayload, u32(1)...) // sample_description_index
+	stscBox := makeBox("stsc", stscPayload)
+
+	stszPayload := append([]byte{0, 0, 0, 0}, u32(100)...) // uniform sample size
+	stszPayload = append(stszPayload, u32(4)...)           // sample count
+	stszBox := makeBox("stsz", stszPayload)
+
+	stcoPayload := append([]byte{0, 0, 0, 0}, u32(2)...)
+	stcoPayload = append(stcoPayload, u32(0)...) // chunk 1 offset, patched below
+	stcoPayload = append(stcoPayload, u32(0)...) // chunk 2 offset, patched below
+	stcoBox := makeBox("stco", stcoPayload)
+	stcoEntriesOffsetInStco := 16
+
+	stblPayload := append(append(append(append([]byte{}, sttsBox...), stssBox...), stscBox...), stszBox...)
+	stcoOffsetInStbl := len(stblPayload) + stcoEntriesOffsetInStco
+	stblPayload = append(stblPayload, stcoBox...)
+	stblBox := makeBox("stbl", stblPayload)
+
+	minfBox := makeBox("minf", stblBox)
+	stcoOffsetInMinf := 8 + stcoOffsetInStbl // stbl's own header precedes it in minf's payload
+
+	mdiaPayload := append(append([]byte{}, mdhdBox...), minfBox...)
+	stcoOffsetInMdia := len(mdhdBox) + 8 + stcoOffsetInMinf // minf's own header precedes it
+	mdiaBox := makeBox("mdia", mdiaPayload)
+
+	trakBox := makeBox("trak", mdiaBox)
+	stcoOffsetInTrak := 8 + stcoOffsetInMdia // mdia's own header precedes it
+
+	moovBox := makeBox("moov", trakBox)
+	// moov's own header precedes its payload (trakBox) in turn, so the
+	// entries sit 8 bytes further into the full moov box than they do
+	// into moov's payload.
+	stcoOffsetInMoov := 8 + 8 + stcoOffsetInTrak
+
+	mdatPayload := make([]byte, 400) // 4 samples x 100 bytes, contents unused by the parser
+	mdatBox := makeBox("mdat", mdatPayload)
+
+	mdatPayloadStart := int64(len(ftypBox) + len(moovBox) + 8)
+	chunk1Offset := mdatPayloadStart
+	chunk2Offset := mdatPayloadStart + 200
+
+	binary.BigEndian.PutUint32(moovBox[stcoOffsetInMoov:stcoOffsetInMoov+4], uint32(chunk1Offset))
+	binary.BigEndian.PutUint32(moovBox[stcoOffsetInMoov+4:stcoOffsetInMoov+8], uint32(chunk2Offset))
+
+	file = append(append(append([]byte{}, ftypBox...), moovBox...), mdatBox...)
+	return file, chunk2Offset
+}
+
+// rangeServer serves file over HTTP, honoring Range requests the way an
+// origin that supports byte-range GETs would, which is all parseMP4
+// needs from it.
+func rangeServer(file []byte) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rng := r.Header.Get("Range")
+		if rng == "" {
+			w.Write(file)
+			return
+		}
+
+		spec := strings.TrimPrefix(rng, "bytes=")
+		parts := strings.SplitN(spec, "-", 2)
+		start, _ := strconv.Atoi(parts[0])
+		end, _ := strconv.Atoi(parts[1])
+		if end >= len(file) {
+			end = len(file) - 1
+		}
+
+		w.Header().Set("Content-Range", "bytes "+spec+"/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(file[start : end+1])
+	}))
+}
+
+func TestParseMP4AndSeekToSyncSample(t *testing.T) {
+	file, wantTrimOffset := buildSyntheticMP4(t)
+	srv := rangeServer(file)
+	defer srv.Close()
+
+	info, err := parseMP4(http.DefaultClient, srv.URL, int64(len(file)))
+	if err != nil {
+		t.Fatalf("parseMP4: %v", err)
+	}
+	if len(info.tracks) != 1 {
+		t.Fatalf("expected 1 track, got %d", len(info.tracks))
+	}
+	if info.tracks[0].timescale != 1000 {
+		t.Errorf("expected timescale 1000, got %d", info.tracks[0].timescale)
+	}
+
+	// Seeking to 2s lands on sample 3 (1s per sample), which snaps to the
+	// sync sample at 3 and so the second chunk, not the first.
+	rng, moov := info.seek(2.0)
+	if rng.Start != int(wantTrimOffset) {
+		t.Errorf("expected trim offset %d, got %d", wantTrimOffset, rng.Start)
+	}
+	if rng.End != len(file) {
+		t.Errorf("expected range end %d, got %d", len(file), rng.End)
+	}
+
+	moovBox, ok := findBox(mustParseBoxes(t, moov, 0), "moov")
+	if !ok {
+		t.Fatal("patched moov missing its own moov box header")
+	}
+	trakChildren := mustParseBoxes(t, moovBox.payload(moov, 0), moovBox.PayloadStart)
+	trak, _ := findBox(trakChildren, "trak")
+	mdiaChildren := mustParseBoxes(t, trak.payload(moov, 0), trak.PayloadStart)
+	mdia, _ := findBox(mdiaChildren, "mdia")
+	minfChildren := mustParseBoxes(t, mdia.payload(moov, 0), mdia.PayloadStart)
+	minf, _ := findBox(minfChildren, "minf")
+	stblChildren := mustParseBoxes(t, minf.payload(moov, 0), minf.PayloadStart)
+	stbl, _ := findBox(stblChildren, "stbl")
+	stco, _ := findBox(mustParseBoxes(t, stbl.payload(moov, 0), stbl.PayloadStart), "stco")
+
+	offsets := parseChunkOffsets(stco.payload(moov, 0), false)
+	if len(offsets) != 2 {
+		t.Fatalf("expected 2 chunk offsets in the patched stco, got %d", len(offsets))
+	}
+	for i, o := range offsets {
+		if o != 0 {
+			t.Errorf("expected patched chunk offset %d to be clamped to 0 relative to the new mdat, got %d", i, o)
+		}
+	}
+}
+
+func TestParseBoxesRejectsOverflowingLargesize(t *testing.T) {
+	// size == 1 signals a 64-bit largesize follows; one with the high bit
+	// set would cast to a negative int64 and drive pos negative on the
+	// next iteration instead of being treated as unparseable.
+	data := make([]byte, 16)
+	binary.BigEndian.PutUint32(data[0:4], 1)
+	copy(data[4:8], "mdat")
+	binary.BigEndian.PutUint64(data[8:16], 0xFFFFFFFFFFFFFFFF)
+
+	boxes, truncated := parseBoxes(data, 0)
+	if !truncated {
+		t.Error("expected an overflowing largesize to be reported as truncated/unparseable")
+	}
+	if len(boxes) != 0 {
+		t.Errorf("expected no boxes to be returned for an unparseable largesize, got %+v", boxes)
+	}
+}
+
+func mustParseBoxes(t *testing.T, data []byte, base int64) []box {
+	t.Helper()
+	boxes, _ := parseBoxes(data, base)
+	return boxes
+}
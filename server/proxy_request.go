@@ -1,12 +1,20 @@
 package server
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"math"
+	"mime/multipart"
 	"net/http"
+	"net/textproto"
 	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
 
 	"github.com/ldelossa/vimeoserver/cache"
 )
@@ -17,26 +25,15 @@ var (
 	ErrInvalidSource = errors.New("Invalid source")
 )
 
-func (s *VimeoService) proxyRequest(w http.ResponseWriter, r *http.Request) {
-	var ranges []int // Slice holding provided ranges if provided
-	var err error
-	var respBytes []byte       // Byte array holding response from origin
-	var rangeProvided bool     // Is range provided?
-	var byteRangeString string // String containing passed byte range URL param
+// unresolvedRangeEnd stands in for an open-ended range's upper bound when
+// the origin's HEAD response omitted Content-Length, so the source's
+// actual length is unknown at validation time.
+const unresolvedRangeEnd = math.MaxInt32
 
+func (s *VimeoService) proxyRequest(w http.ResponseWriter, r *http.Request) {
 	// parse params out of url
 	params := r.URL.Query()
 
-	// validate range header if present, set appropriate variables
-	if s, ok := params["range"]; ok {
-		if ranges, err = rangeValidation(s[0], w); err != nil {
-			rangeProvided = false
-			return
-		}
-		rangeProvided = true
-		byteRangeString = s[0]
-	}
-
 	// we need a source address in our request parameters
 	if _, ok := params["s"]; !ok {
 		http.Error(w, "Source string not provided", http.StatusBadRequest)
@@ -45,93 +42,313 @@ func (s *VimeoService) proxyRequest(w http.ResponseWriter, r *http.Request) {
 
 	// Test url is valid
 	sourceURL := strings.Trim(params["s"][0], "\"")
-	if err = s.sourceValidation(sourceURL, w); err != nil {
+	contentLength, err := s.sourceValidation(sourceURL, w)
+	if err != nil {
+		return
+	}
+
+	// validate range header if present, set appropriate variables
+	rp, rangeProvided := params["range"]
+	if !rangeProvided {
+		s.proxyFull(w, sourceURL)
+		return
+	}
+
+	ranges, err := rangeValidation(rp[0], contentLength, w)
+	if err != nil {
+		return
+	}
+
+	// A single requested range is the common case, serve it directly with
+	// a normal 206 + Content-Range response.
+	if len(ranges) == 1 {
+		s.proxySingleRange(w, r.Context(), sourceURL, ranges[0])
+		return
+	}
+
+	// Multiple byte-ranges in one request get served as a single
+	// multipart/byteranges body, one part per range, per the HTTP Range spec.
+	s.proxyMultiRange(w, r.Context(), sourceURL, ranges)
+}
+
+// proxyFull proxies a request with no byte range straight through to the
+// origin, uncached.
+func (s *VimeoService) proxyFull(w http.ResponseWriter, sourceURL string) {
+	req, err := http.NewRequest("GET", sourceURL, nil)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Perform request, close body on function close, handle errors
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	defer resp.Body.Close()
+
+	respBytes, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	w.Write(respBytes)
+}
+
+// proxySingleRange serves rng for sourceURL, streaming cached chunks and
+// freshly fetched gaps, in order, straight to w as a 206 response. Gap
+// bytes are never buffered in full: a background fetch commits them to the
+// cache chunk by chunk, and each chunk is forwarded to w out of the cache
+// once it's committed (see streamGap).
+func (s *VimeoService) proxySingleRange(w http.ResponseWriter, ctx context.Context, sourceURL string, rng cache.Range) {
+	result, err := s.cache.Get(rng.Start, rng.End, sourceURL)
+	if err != nil && err != cache.ErrCacheMiss && err != cache.ErrPartialHit {
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	// If range provided, attempt cache serve, store array response in respBytes
-	if rangeProvided {
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", rng.Start, rng.End-1))
+	w.WriteHeader(http.StatusPartialContent)
+
+	// Headers are already flushed at this point, an error streaming the
+	// body is reported by simply stopping, there's no status code left to
+	// change.
+	s.streamResult(w, ctx, sourceURL, result)
+}
+
+// proxyMultiRange serves ranges for sourceURL as a single
+// multipart/byteranges response, streaming each part the same way
+// proxySingleRange streams a single range.
+func (s *VimeoService) proxyMultiRange(w http.ResponseWriter, ctx context.Context, sourceURL string, ranges []cache.Range) {
+	mw := multipart.NewWriter(w)
+	defer mw.Close()
 
-		// Attempt cache lookup
-		respBytes, err = s.cache.Get(ranges[0], ranges[1], sourceURL)
+	w.Header().Set("Content-Type", "multipart/byteranges; boundary="+mw.Boundary())
+	w.WriteHeader(http.StatusPartialContent)
 
-		// If found in cache, return respBytes to ResponseWriter and return
-		if err != cache.ErrCacheMiss {
-			w.Write(respBytes)
+	for _, rng := range ranges {
+		result, err := s.cache.Get(rng.Start, rng.End, sourceURL)
+		if err != nil && err != cache.ErrCacheMiss && err != cache.ErrPartialHit {
 			return
 		}
 
-		// If cache miss: create new request, add appropraite header, place into cache, and return respBytes
-		req, err := http.NewRequest("GET", sourceURL, nil)
+		partHeader := textproto.MIMEHeader{}
+		partHeader.Set("Content-Range", fmt.Sprintf("bytes %d-%d/*", rng.Start, rng.End-1))
+		part, err := mw.CreatePart(partHeader)
 		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		// Add Range header to new request
-		req.Header.Add("Range", "bytes="+strings.Trim(byteRangeString, "\""))
 
-		// Perform request, close body on function close, handle errors
-		resp, err := s.httpClient.Do(req)
-		defer resp.Body.Close()
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		if err := s.streamResult(part, ctx, sourceURL, result); err != nil {
+			return
 		}
+	}
+}
 
-		// do not cache non 206 codes
-		if resp.StatusCode == 206 {
-			// Copy bytes from resp.Body to respBytes buffer to place in cache
-			respBytes, err = ioutil.ReadAll(resp.Body)
-			if err != nil {
-				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			}
+// streamResult writes every chunk and gap in result, in ascending byte
+// order, to w. Chunks already held by the cache are written directly; gaps
+// are streamed from the origin as they arrive.
+func (s *VimeoService) streamResult(w io.Writer, ctx context.Context, sourceURL string, result *cache.GetResult) error {
+	type segment struct {
+		cache.Range
+		chunk *cache.Chunk
+	}
+
+	segments := make([]segment, 0, len(result.Chunks)+len(result.Gaps))
+	for i := range result.Chunks {
+		segments = append(segments, segment{Range: result.Chunks[i].Range, chunk: &result.Chunks[i]})
+	}
+	for _, gap := range result.Gaps {
+		segments = append(segments, segment{Range: gap})
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Start < segments[j].Start })
 
-			// Asyc place bytes into cache
-			go s.cache.Put(ranges[0], ranges[1], respBytes, sourceURL)
+	for _, seg := range segments {
+		if seg.chunk != nil {
+			if _, err := w.Write(seg.chunk.Buffer); err != nil {
+				return err
+			}
+			continue
+		}
 
-			// Write respBytes to ResponseWriter and return
-			w.Write(respBytes)
-			return
+		if err := s.streamGap(w, ctx, sourceURL, seg.Range); err != nil {
+			return err
 		}
-		// If no range provided, simpley proxy the response
+	}
+	return nil
+}
+
+// streamGap streams gap's bytes to w, coalescing with any other caller
+// currently streaming the same sourceURL and gap onto a single origin
+// fetch: the first caller to ask becomes the leader and performs the
+// fetch in the background, committing bytes to the cache as they
+// arrive; every caller, leader included, then streams those bytes back
+// out of the cache as they're committed, so there's exactly one origin
+// request and no second in-memory copy of the gap.
+func (s *VimeoService) streamGap(w io.Writer, ctx context.Context, sourceURL string, gap cache.Range) error {
+	key := gapKey(sourceURL, gap)
+
+	s.inflightLock.Lock()
+	f, ok := s.inflight[key]
+	if !ok {
+		f = newOriginFetch()
+		s.inflight[key] = f
+	}
+	s.inflightLock.Unlock()
+
+	if ok {
+		atomic.AddInt64(&s.metrics.coalescedHits, 1)
 	} else {
+		atomic.AddInt64(&s.metrics.originFetches, 1)
+		go s.fetchGapOrigin(sourceURL, gap, f, key)
+	}
 
-		req, err := http.NewRequest("GET", sourceURL, nil)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-			return
+	return s.streamGapFollow(ctx, w, sourceURL, gap, f)
+}
+
+// streamGapFollow writes gap's bytes to w as f's origin fetch commits
+// them to the cache. Each pass copies out of the cache everything
+// committed between offset and gap.End and forwards the contiguous part,
+// so how much it holds at once depends on how far the fetch has run ahead
+// of this caller; it isn't limited to one chunk. ctx cancellation only
+// stops this one caller; the fetch keeps running for any other caller
+// still following it.
+func (s *VimeoService) streamGapFollow(ctx context.Context, w io.Writer, sourceURL string, gap cache.Range, f *originFetch) error {
+	offset := gap.Start
+	fetchDone := false
+	for {
+		result, err := s.cache.Get(offset, gap.End, sourceURL)
+		if err != nil && err != cache.ErrCacheMiss && err != cache.ErrPartialHit {
+			return err
 		}
 
-		// Perform request, close body on function close, handle errors
-		resp, err := s.httpClient.Do(req)
-		defer resp.Body.Close()
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		wrote := false
+		if result != nil {
+			for _, chunk := range result.Chunks {
+				if chunk.Start != offset {
+					// Not the next contiguous chunk yet; wait for it.
+					break
+				}
+				if _, werr := w.Write(chunk.Buffer); werr != nil {
+					return werr
+				}
+				offset = chunk.End
+				wrote = true
+			}
 		}
-		respBytes, err = ioutil.ReadAll(resp.Body)
-		if err != nil {
-			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+
+		if offset >= gap.End {
+			return nil
+		}
+		if wrote {
+			continue
+		}
+		if fetchDone {
+			// The fetch finished and a final look at the cache still left
+			// nothing contiguous to forward. Normally offset would have
+			// already reached gap.End above; but for an open-ended gap
+			// whose end is unresolvedRangeEnd, the origin's actual bytes
+			// run out first, and there's nothing left to wait for.
+			return nil
+		}
+
+		done, ferr := f.wait(ctx)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if done {
+			if ferr != nil {
+				return ferr
+			}
+			fetchDone = true
 		}
-		w.Write(respBytes)
+		// Progress was made, or the fetch just finished; either way loop
+		// around and re-check the cache before deciding there's nothing
+		// left.
 	}
 }
 
-// Confirm that the source is valid
-func (s *VimeoService) sourceValidation(sourceURL string, w http.ResponseWriter) error {
+// fetchGapOrigin performs the single origin fetch backing an originFetch:
+// it issues the ranged GET and writes the response straight into the
+// cache's chunked CacheWriter, signalling f after every write so any
+// followers in streamGapFollow can pick up newly committed chunks.
+func (s *VimeoService) fetchGapOrigin(sourceURL string, gap cache.Range, f *originFetch, key string) {
+	defer func() {
+		s.inflightLock.Lock()
+		delete(s.inflight, key)
+		s.inflightLock.Unlock()
+	}()
+
+	req, err := http.NewRequest("GET", sourceURL, nil)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	req.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", gap.Start, gap.End-1))
+
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+	defer resp.Body.Close()
+
+	// Origin did not honor the range request, do not cache or stitch a
+	// full body in where only a slice was asked for.
+	if resp.StatusCode != http.StatusPartialContent {
+		f.finish(ErrInvalidRange)
+		return
+	}
+
+	writer, err := s.cache.NewWriter(gap.Start, sourceURL)
+	if err != nil {
+		f.finish(err)
+		return
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, rerr := resp.Body.Read(buf)
+		if n > 0 {
+			if _, werr := writer.Write(buf[:n]); werr != nil {
+				writer.Close()
+				f.finish(werr)
+				return
+			}
+			f.progress()
+		}
+		if rerr != nil {
+			writer.Close()
+			if rerr == io.EOF {
+				f.finish(nil)
+			} else {
+				f.finish(rerr)
+			}
+			return
+		}
+	}
+}
+
+// Confirm that the source is valid, returns the origin's advertised
+// Content-Length (0 if the origin did not provide one) for use in
+// validating requested byte ranges.
+func (s *VimeoService) sourceValidation(sourceURL string, w http.ResponseWriter) (int64, error) {
 	if _, err := url.ParseRequestURI(sourceURL); err != nil {
 		http.Error(w, "Bad source string", http.StatusBadRequest)
-		return ErrInvalidSource
+		return 0, ErrInvalidSource
 	}
 
 	// Determine if source address supports range requests
 	resp, err := s.httpClient.Head(sourceURL)
 	if err != nil {
 		http.Error(w, "Bad source string, does not support range requests", http.StatusBadRequest)
-		return ErrInvalidSource
+		return 0, ErrInvalidSource
 	}
 
 	if _, ok := resp.Header["Accept-Ranges"]; !ok {
 		http.Error(w, "Source does not accept range requests", http.StatusBadRequest)
-		return ErrInvalidSource
+		return 0, ErrInvalidSource
 	}
 
 	for _, b := range resp.Header["Accept-Ranges"] {
@@ -139,42 +356,118 @@ func (s *VimeoService) sourceValidation(sourceURL string, w http.ResponseWriter)
 			break
 		} else {
 			http.Error(w, "Source does not accept range requests", http.StatusBadRequest)
-			return ErrInvalidSource
+			return 0, ErrInvalidSource
 		}
 	}
 
 	// Proxy source content type to caller
 	w.Header().Set("Content-Type", resp.Header["Content-Type"][0])
-	return nil
+
+	contentLength := resp.ContentLength
+	if contentLength < 0 {
+		contentLength = 0
+	}
+
+	return contentLength, nil
 }
 
-// confirm that range value is valid
-func rangeValidation(brange string, w http.ResponseWriter) ([]int, error) {
-	tokens := strings.Split(brange, "-")
+// rangeValidation parses an HTTP Range header value (the part after
+// "bytes=", not including the unit) into one or more concrete, half-open
+// byte ranges. It supports a plain "start-end" range, a suffix range
+// ("-500", the last 500 bytes), an open-ended range ("500-", from 500 to
+// the end of the source), and comma separated multi-range requests
+// ("0-99,200-299"). contentLength (from the origin's HEAD response) is used
+// to resolve suffix/open-ended ranges and to bound validation; pass 0 if
+// unknown. An unknown contentLength makes a suffix range unresolvable, so
+// it's rejected, but an open-ended range still resolves, to
+// unresolvedRangeEnd.
+func rangeValidation(brange string, contentLength int64, w http.ResponseWriter) ([]cache.Range, error) {
+	specs := strings.Split(strings.Trim(brange, "\""), ",")
 
-	// Range should always have two values
-	if len(tokens) != 2 {
-		http.Error(w, "Bad byte range", http.StatusBadRequest)
-		return nil, ErrInvalidRange
-	}
+	ranges := make([]cache.Range, 0, len(specs))
+	for _, spec := range specs {
+		tokens := strings.SplitN(strings.TrimSpace(spec), "-", 2)
 
-	// Convert strings to ints
-	r1, err := strconv.Atoi(strings.Trim(tokens[0], "\""))
-	if err != nil {
-		http.Error(w, "Bad byte range", http.StatusBadRequest)
-		return nil, ErrInvalidRange
-	}
-	r2, err := strconv.Atoi(strings.Trim(tokens[1], "\""))
-	if err != nil {
-		http.Error(w, "Bad byte range", http.StatusBadRequest)
-		return nil, ErrInvalidRange
-	}
+		// Range should always have two tokens
+		if len(tokens) != 2 {
+			http.Error(w, "Bad byte range", http.StatusBadRequest)
+			return nil, ErrInvalidRange
+		}
+
+		startToken := strings.TrimSpace(tokens[0])
+		endToken := strings.TrimSpace(tokens[1])
+
+		var start, end int
+		switch {
+		case startToken == "" && endToken == "":
+			http.Error(w, "Bad byte range", http.StatusBadRequest)
+			return nil, ErrInvalidRange
+
+		case startToken == "":
+			// Suffix range, last N bytes of the source. Unresolvable
+			// without a known length, unlike an open-ended range, so
+			// reject it outright rather than silently returning the
+			// degenerate {0, 0} that an unknown contentLength would
+			// otherwise produce.
+			if contentLength <= 0 {
+				http.Error(w, "Bad byte range", http.StatusBadRequest)
+				return nil, ErrInvalidRange
+			}
+			n, err := strconv.Atoi(endToken)
+			if err != nil || n <= 0 {
+				http.Error(w, "Bad byte range", http.StatusBadRequest)
+				return nil, ErrInvalidRange
+			}
+			start = int(contentLength) - n
+			if start < 0 {
+				start = 0
+			}
+			end = int(contentLength)
+
+		case endToken == "":
+			// Open ended range, from N to the end of the source. A
+			// missing Content-Length doesn't make this unresolvable: per
+			// RFC 7233 ss 2.1, a last-byte-pos beyond the resource's
+			// actual length is clamped to its end, so resolving to
+			// unresolvedRangeEnd lets the origin serve everything from N
+			// onward exactly as an open range would.
+			n, err := strconv.Atoi(startToken)
+			if err != nil {
+				http.Error(w, "Bad byte range", http.StatusBadRequest)
+				return nil, ErrInvalidRange
+			}
+			start = n
+			if contentLength > 0 {
+				end = int(contentLength)
+			} else {
+				end = unresolvedRangeEnd
+			}
+
+		default:
+			r1, err := strconv.Atoi(startToken)
+			if err != nil {
+				http.Error(w, "Bad byte range", http.StatusBadRequest)
+				return nil, ErrInvalidRange
+			}
+			r2, err := strconv.Atoi(endToken)
+			if err != nil {
+				http.Error(w, "Bad byte range", http.StatusBadRequest)
+				return nil, ErrInvalidRange
+			}
+			start = r1
+			// HTTP ranges are inclusive of end, our ranges are half-open
+			end = r2 + 1
+		}
+
+		// Start range should always be less then end, and within the
+		// origin's advertised length when known
+		if start >= end || start < 0 || (contentLength > 0 && end > int(contentLength)) {
+			http.Error(w, "Bad byte range", http.StatusBadRequest)
+			return nil, ErrInvalidRange
+		}
 
-	// Start range should always be less then end
-	if r1 > r2 {
-		http.Error(w, "Bad byte range", http.StatusBadRequest)
-		return nil, ErrInvalidRange
+		ranges = append(ranges, cache.Range{Start: start, End: end})
 	}
 
-	return []int{r1, r2}, nil
+	return ranges, nil
 }
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRangeValidationUnknownContentLength(t *testing.T) {
+	// An open-ended range is still resolvable without a known
+	// Content-Length: it just runs to unresolvedRangeEnd instead of a
+	// concrete length.
+	rr := httptest.NewRecorder()
+	ranges, err := rangeValidation("100-", 0, rr)
+	if err != nil {
+		t.Fatalf("rangeValidation returned unexpected error: %v", err)
+	}
+	if len(ranges) != 1 || ranges[0].Start != 100 || ranges[0].End != unresolvedRangeEnd {
+		t.Errorf("got %+v, want a single range {100, %d}", ranges, unresolvedRangeEnd)
+	}
+
+	// A suffix range can't be resolved without a known length, so it
+	// should be rejected rather than silently returning {0, 0}.
+	rr = httptest.NewRecorder()
+	if _, err := rangeValidation("-100", 0, rr); err != ErrInvalidRange {
+		t.Errorf("expected ErrInvalidRange for a suffix range with unknown contentLength, got %v", err)
+	}
+	if rr.Code != 400 {
+		t.Errorf("expected 400 for a suffix range with unknown contentLength, got %v", rr.Code)
+	}
+}
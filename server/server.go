@@ -2,7 +2,9 @@ package server
 
 import (
 	"net/http"
-	"vimeoserver/cache"
+	"sync"
+
+	"github.com/ldelossa/vimeoserver/cache"
 )
 
 // VimeoService struct
@@ -10,17 +12,35 @@ type VimeoService struct {
 	HTTPServer *http.Server
 	httpClient *http.Client
 	cache      cache.Cache
+
+	// mp4Infos caches each sourceURL's parsed moov box so repeat seeks
+	// into the same video skip straight to the offset math.
+	mp4Infos map[string]*mp4Info
+	mp4Lock  sync.Mutex
+
+	// inflight coalesces concurrent cache-miss origin fetches for the
+	// same sourceURL and byte range onto a single originFetch.
+	inflight     map[string]*originFetch
+	inflightLock sync.Mutex
+	metrics      cacheMetrics
 }
 
-// NewVimeoService Get new instance
-func NewVimeoService() *VimeoService {
+// NewVimeoService Get new instance, with its cache built per config
+func NewVimeoService(config CacheConfig) (*VimeoService, error) {
+	c, err := buildCache(config)
+	if err != nil {
+		return nil, err
+	}
+
 	service := &VimeoService{
 		httpClient: &http.Client{},
-		cache:      cache.NewMemCache(64),
+		cache:      c,
+		mp4Infos:   make(map[string]*mp4Info),
+		inflight:   make(map[string]*originFetch),
 	}
 
 	service.HTTPServer = &http.Server{Addr: "localhost:8000", Handler: createHandlers(service)}
-	return service
+	return service, nil
 }
 
 // Attaches handlers to mux
@@ -28,5 +48,7 @@ func createHandlers(s *VimeoService) *http.ServeMux {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/", s.proxyRequest)
+	mux.HandleFunc("/mp4", s.mp4Request)
+	mux.HandleFunc("/debug/cache", s.debugCacheRequest)
 	return mux
 }
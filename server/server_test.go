@@ -22,7 +22,10 @@ func TestSourceValidationUrl(t *testing.T) {
 	badSources := []string{"ht/www.example.com", "://www.example.com"}
 	responseString := "Bad source string\n"
 
-	serv := NewVimeoService()
+	serv, err := NewVimeoService(DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(serv.proxyRequest)
@@ -70,10 +73,13 @@ func TestSourceValidationUrl(t *testing.T) {
 func TestSourceValidationByteRange(t *testing.T) {
 	var vrList []*validationResponse
 	responseString := "Bad byte range\n"
-	badRanges := []string{"100-0", "100-", "-100", "-", ""}
+	badRanges := []string{"100-0", "-", ""}
 	goodSource := "http://storage.googleapis.com/vimeo-test/work-at-vimeo.mp4"
 
-	serv := NewVimeoService()
+	serv, err := NewVimeoService(DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(serv.proxyRequest)
@@ -118,12 +124,49 @@ func TestSourceValidationByteRange(t *testing.T) {
 	}
 }
 
+func TestExtendedRangeSyntax(t *testing.T) {
+	fmt.Println("====EXTENDED BYTE RANGE SYNTAX TEST=====")
+	goodSource := "http://storage.googleapis.com/vimeo-test/work-at-vimeo.mp4"
+	goodRanges := []string{"100-", "-100", "0-99,200-299"}
+
+	serv, err := NewVimeoService(DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range goodRanges {
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(serv.proxyRequest)
+
+		req, err := http.NewRequest("GET", "/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		q := req.URL.Query()
+		q.Add("s", goodSource)
+		q.Add("range", r)
+		req.URL.RawQuery = q.Encode()
+
+		handler.ServeHTTP(rr, req)
+
+		fmt.Printf("Source URL: %v ByteRange: %v Response Code: %v\n", goodSource, r, rr.Code)
+
+		if rr.Code != http.StatusPartialContent {
+			t.Errorf("expected range %v to be accepted with a 206, got %v", r, rr.Code)
+		}
+	}
+}
+
 func TestSourceValidationSourceByteServes(t *testing.T) {
 	fmt.Println("====NO ACCEPT-RANGES HEADER TEST=====")
 	responseString := "Source does not accept range requests\n"
 	goodSource := "http://www.google.com"
 
-	serv := NewVimeoService()
+	serv, err := NewVimeoService(DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(serv.proxyRequest)
@@ -165,7 +208,10 @@ func TestResponseByteSize(t *testing.T) {
 	ranges := []string{"0-100", "500-1000", "10000-20000"}
 	goodSource := "http://storage.googleapis.com/vimeo-test/work-at-vimeo.mp4"
 
-	serv := NewVimeoService()
+	serv, err := NewVimeoService(DefaultCacheConfig())
+	if err != nil {
+		t.Fatal(err)
+	}
 
 	rr := httptest.NewRecorder()
 	handler := http.HandlerFunc(serv.proxyRequest)
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/ldelossa/vimeoserver/cache"
+)
+
+// originFetch coalesces one in-flight origin fetch across any number of
+// concurrent followers: the fetch itself runs once, in the background,
+// writing straight into the cache's own chunked CacheWriter. Followers
+// don't share a buffer with the fetch; they read whatever the fetch has
+// already committed to the cache and wait on this for word of more. Each
+// such read copies everything committed past the follower's offset, so a
+// follower that keeps up holds about one cache chunk at a time and one
+// that falls behind holds more.
+type originFetch struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	done bool
+	err  error
+}
+
+func newOriginFetch() *originFetch {
+	f := &originFetch{}
+	f.cond = sync.NewCond(&f.mu)
+	return f
+}
+
+// progress wakes any follower waiting for newly committed bytes.
+func (f *originFetch) progress() {
+	f.mu.Lock()
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// finish marks the fetch complete, successfully or not, and wakes every
+// follower so each can take a final look at the cache and return.
+func (f *originFetch) finish(err error) {
+	f.mu.Lock()
+	f.done = true
+	f.err = err
+	f.cond.Broadcast()
+	f.mu.Unlock()
+}
+
+// wait blocks until the fetch makes progress, finishes, or ctx is
+// cancelled, returning whether the fetch had already finished and its
+// error if so. A cancelled ctx only wakes this one caller; it has no
+// effect on the fetch itself or on any other follower waiting on it, so
+// one disconnected client can't wedge the rest.
+func (f *originFetch) wait(ctx context.Context) (done bool, err error) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			f.mu.Lock()
+			f.cond.Broadcast()
+			f.mu.Unlock()
+		case <-stop:
+		}
+	}()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.done && ctx.Err() == nil {
+		f.cond.Wait()
+	}
+	return f.done, f.err
+}
+
+// gapKey identifies an in-flight origin fetch by the exact byte range
+// being fetched from sourceURL, so only requests for the same gap
+// coalesce onto the same fetch.
+func gapKey(sourceURL string, gap cache.Range) string {
+	return fmt.Sprintf("%s\x00%d-%d", sourceURL, gap.Start, gap.End)
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ldelossa/vimeoserver/cache"
+)
+
+func TestStreamGapCoalescesConcurrentFetches(t *testing.T) {
+	want := bytes.Repeat([]byte("a"), 1000)
+	var originHits int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&originHits, 1)
+		// Hold the origin request open briefly so every follower has a
+		// chance to join before the leader finishes, proving they share
+		// one fetch rather than racing independent ones.
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Range", "bytes 0-999/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(want)
+	}))
+	defer srv.Close()
+
+	s := &VimeoService{
+		httpClient: &http.Client{},
+		cache:      cache.NewMemCache(16, 16, 0),
+		inflight:   make(map[string]*originFetch),
+	}
+	gap := cache.Range{Start: 0, End: 1000}
+
+	const followers = 5
+	results := make([]bytes.Buffer, followers)
+	var wg sync.WaitGroup
+	for i := 0; i < followers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := s.streamGap(&results[i], context.Background(), srv.URL, gap); err != nil {
+				t.Errorf("streamGap: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	if got := atomic.LoadInt32(&originHits); got != 1 {
+		t.Errorf("expected exactly 1 origin request, got %d", got)
+	}
+	if got := atomic.LoadInt64(&s.metrics.originFetches); got != 1 {
+		t.Errorf("expected origin_fetches metric of 1, got %d", got)
+	}
+	if got := atomic.LoadInt64(&s.metrics.coalescedHits); got != followers-1 {
+		t.Errorf("expected coalesced_hits metric of %d, got %d", followers-1, got)
+	}
+	for i, buf := range results {
+		if !bytes.Equal(buf.Bytes(), want) {
+			t.Errorf("follower %d got %d bytes, want %d matching bytes", i, buf.Len(), len(want))
+		}
+	}
+}
+
+func TestStreamGapFollowerCancellationDoesNotAffectOthers(t *testing.T) {
+	want := bytes.Repeat([]byte("b"), 500)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Content-Range", "bytes 0-499/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(want)
+	}))
+	defer srv.Close()
+
+	s := &VimeoService{
+		httpClient: &http.Client{},
+		cache:      cache.NewMemCache(16, 16, 0),
+		inflight:   make(map[string]*originFetch),
+	}
+	gap := cache.Range{Start: 0, End: 500}
+
+	cancelledCtx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var cancelledErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		cancelledErr = s.streamGap(new(bytes.Buffer), cancelledCtx, srv.URL, gap)
+	}()
+	cancel() // cancel the follower immediately, well before the origin responds
+
+	var okBuf bytes.Buffer
+	var okErr error
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		okErr = s.streamGap(&okBuf, context.Background(), srv.URL, gap)
+	}()
+	wg.Wait()
+
+	if cancelledErr == nil {
+		t.Error("expected the cancelled follower to return an error")
+	}
+	if okErr != nil {
+		t.Errorf("expected the other follower to succeed, got %v", okErr)
+	}
+	if !bytes.Equal(okBuf.Bytes(), want) {
+		t.Errorf("got %d bytes, want %d matching bytes", okBuf.Len(), len(want))
+	}
+}
+
+func TestStreamGapFollowOpenEndedGapStopsAtOriginEOF(t *testing.T) {
+	// An open-ended range with an unknown Content-Length resolves to a gap
+	// ending at unresolvedRangeEnd, far past what the origin actually
+	// sends. streamGapFollow must stop when the origin runs out of bytes
+	// rather than waiting forever for offset to reach that sentinel.
+	want := bytes.Repeat([]byte("c"), 250)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Range", "bytes 0-249/*")
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(want)
+	}))
+	defer srv.Close()
+
+	s := &VimeoService{
+		httpClient: &http.Client{},
+		cache:      cache.NewMemCache(16, 16, 0),
+		inflight:   make(map[string]*originFetch),
+	}
+	gap := cache.Range{Start: 0, End: unresolvedRangeEnd}
+
+	done := make(chan error, 1)
+	var buf bytes.Buffer
+	go func() { done <- s.streamGap(&buf, context.Background(), srv.URL, gap) }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("streamGap: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("streamGap did not return; likely spinning waiting for offset to reach unresolvedRangeEnd")
+	}
+
+	if !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("got %d bytes, want %d matching bytes", buf.Len(), len(want))
+	}
+}
+
+func TestDebugCacheRequestReportsMetrics(t *testing.T) {
+	s := &VimeoService{
+		httpClient: &http.Client{},
+		cache:      cache.NewMemCache(16, 16, 0),
+		inflight:   make(map[string]*originFetch),
+	}
+	s.metrics.originFetches = 3
+	s.metrics.coalescedHits = 7
+
+	req := httptest.NewRequest("GET", "/debug/cache", nil)
+	rr := httptest.NewRecorder()
+	s.debugCacheRequest(rr, req)
+
+	body := rr.Body.String()
+	want := fmt.Sprintf(`{"origin_fetches":%d,"coalesced_hits":%d}`, 3, 7)
+	if bytes.TrimSpace(rr.Body.Bytes())[0] != '{' || !bytes.Contains([]byte(body), []byte(`"origin_fetches":3`)) || !bytes.Contains([]byte(body), []byte(`"coalesced_hits":7`)) {
+		t.Errorf("expected body to contain metrics like %s, got %s", want, body)
+	}
+}